@@ -0,0 +1,333 @@
+package gproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errNoFlows       = errors.New("flow capture disabled")
+	errNoBreakpoints = errors.New("breakpoints disabled")
+	errNoH2View      = errors.New("h2 view disabled")
+	errNoLimit       = errors.New("limit not found")
+	errMethod        = errors.New("method not allowed")
+)
+
+// API is the control api of ProxyHandler
+type API struct {
+	proxy *ProxyHandler
+	mux   *http.ServeMux
+}
+
+// NewAPI returns the control api of ph
+func NewAPI(ph *ProxyHandler) *API {
+	api := &API{
+		proxy: ph,
+		mux:   http.NewServeMux(),
+	}
+	api.mux.HandleFunc("/flows", api.flows)
+	api.mux.HandleFunc("/flows/", api.flow)
+	api.mux.HandleFunc("/har", api.har)
+	api.mux.HandleFunc("/replay", api.replay)
+	api.mux.HandleFunc("/breakpoints", api.breakpoints)
+	api.mux.HandleFunc("/breakpoints/", api.resume)
+	api.mux.HandleFunc("/limits", api.limits)
+	api.mux.HandleFunc("/limits/", api.setLimit)
+	api.mux.HandleFunc("/h2", api.h2)
+	return api
+}
+
+func (api *API) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	api.mux.ServeHTTP(rw, req)
+}
+
+// GET /flows?host=*.example.com&method=GET&status=5xx&since=&until=&replayOf=&limit=
+func (api *API) flows(rw http.ResponseWriter, req *http.Request) {
+	store := api.proxy.Flows
+	if store == nil {
+		apiError(rw, http.StatusNotFound, errNoFlows)
+		return
+	}
+	q, err := parseFlowQuery(req)
+	if err != nil {
+		apiError(rw, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(rw, store.Query(q))
+}
+
+// GET /flows/{id}
+func (api *API) flow(rw http.ResponseWriter, req *http.Request) {
+	store := api.proxy.Flows
+	if store == nil {
+		apiError(rw, http.StatusNotFound, errNoFlows)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(req.URL.Path, "/flows/"), 10, 64)
+	if err != nil {
+		apiError(rw, http.StatusBadRequest, err)
+		return
+	}
+	f := store.Get(id)
+	if f == nil {
+		apiError(rw, http.StatusNotFound, errFlowNotFound)
+		return
+	}
+	writeJSON(rw, f)
+}
+
+// GET /har?host=... 导出 HAR, POST /har 导入 HAR
+func (api *API) har(rw http.ResponseWriter, req *http.Request) {
+	store := api.proxy.Flows
+	if store == nil {
+		apiError(rw, http.StatusNotFound, errNoFlows)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		q, err := parseFlowQuery(req)
+		if err != nil {
+			apiError(rw, http.StatusBadRequest, err)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+		rw.Header().Set("Content-Disposition", `attachment; filename="gproxy.har"`)
+		if err := ExportHAR(rw, store.Query(q)); err != nil {
+			logger.Println("api export har:", err)
+		}
+	case "POST":
+		flows, err := ImportHAR(req.Body)
+		if err != nil {
+			apiError(rw, http.StatusBadRequest, err)
+			return
+		}
+		ids := make([]uint64, 0, len(flows))
+		for _, f := range flows {
+			// 使用新的 id, 避免和已有的冲突
+			f.ID = 0
+			store.Add(f)
+			ids = append(ids, f.ID)
+		}
+		writeJSON(rw, ids)
+	default:
+		apiError(rw, http.StatusMethodNotAllowed, errMethod)
+	}
+}
+
+// POST /replay {"ids":[1,2],"edit":{...},"concurrency":2,"repeat":10,"delay":"100ms"}
+func (api *API) replay(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		apiError(rw, http.StatusMethodNotAllowed, errMethod)
+		return
+	}
+	var r Replay
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		apiError(rw, http.StatusBadRequest, err)
+		return
+	}
+	flows, err := api.proxy.Replay(req.Context(), &r)
+	if err != nil {
+		code := http.StatusBadRequest
+		if err == errNoFlows || err == errFlowNotFound {
+			code = http.StatusNotFound
+		}
+		apiError(rw, code, err)
+		return
+	}
+	writeJSON(rw, flows)
+}
+
+// GET /breakpoints 返回暂停中的请求和响应
+func (api *API) breakpoints(rw http.ResponseWriter, req *http.Request) {
+	b := api.proxy.Breakpoints
+	if b == nil {
+		apiError(rw, http.StatusNotFound, errNoBreakpoints)
+		return
+	}
+	writeJSON(rw, b.Pending())
+}
+
+// POST /breakpoints/{id} {"action":"continue","setHeader":{"X-A":"1"},"body":"..."}
+func (api *API) resume(rw http.ResponseWriter, req *http.Request) {
+	b := api.proxy.Breakpoints
+	if b == nil {
+		apiError(rw, http.StatusNotFound, errNoBreakpoints)
+		return
+	}
+	if req.Method != "POST" {
+		apiError(rw, http.StatusMethodNotAllowed, errMethod)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(req.URL.Path, "/breakpoints/"), 10, 64)
+	if err != nil {
+		apiError(rw, http.StatusBadRequest, err)
+		return
+	}
+	var r Resume
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		apiError(rw, http.StatusBadRequest, err)
+		return
+	}
+	if err := b.Resume(id, &r); err != nil {
+		code := http.StatusBadRequest
+		if err == errBreakpointNotFound {
+			code = http.StatusNotFound
+		}
+		apiError(rw, code, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+type h2ConnStatus struct {
+	Addr    string     `json:"addr"`
+	Start   time.Time  `json:"start"`
+	Streams []H2Stream `json:"streams"`
+}
+
+// GET /h2?host=*.example.com 返回最近的 h2 连接, 按 stream 分组的 frame
+func (api *API) h2(rw http.ResponseWriter, req *http.Request) {
+	v := api.proxy.H2View
+	if v == nil {
+		apiError(rw, http.StatusNotFound, errNoH2View)
+		return
+	}
+	host := req.URL.Query().Get("host")
+	status := []h2ConnStatus{}
+	for _, c := range v.Conns() {
+		if host != "" {
+			h, _, err := net.SplitHostPort(c.Addr)
+			if err != nil {
+				h = c.Addr
+			}
+			if !matchHost(host, h) {
+				continue
+			}
+		}
+		status = append(status, h2ConnStatus{
+			Addr:    c.Addr,
+			Start:   c.Start,
+			Streams: c.Streams(),
+		})
+	}
+	writeJSON(rw, status)
+}
+
+type limitStatus struct {
+	Name   string `json:"name"`
+	Host   string `json:"host,omitempty"`
+	Client string `json:"client,omitempty"`
+	Down   uint   `json:"down"`
+	Up     uint   `json:"up"`
+}
+
+// GET /limits 返回当前的限速
+func (api *API) limits(rw http.ResponseWriter, req *http.Request) {
+	status := []limitStatus{}
+	if rules := api.proxy.Rules; rules != nil {
+		for _, l := range rules.Limits {
+			down, up := l.Limit()
+			status = append(status, limitStatus{
+				Name:   l.Name,
+				Host:   l.Host,
+				Client: l.Client,
+				Down:   down,
+				Up:     up,
+			})
+		}
+	}
+	writeJSON(rw, status)
+}
+
+// POST /limits/{name} {"down":262144,"up":0}, 0 不限制
+func (api *API) setLimit(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		apiError(rw, http.StatusMethodNotAllowed, errMethod)
+		return
+	}
+	var l *LimitRule
+	if rules := api.proxy.Rules; rules != nil {
+		l = rules.FindLimit(strings.TrimPrefix(req.URL.Path, "/limits/"))
+	}
+	if l == nil {
+		apiError(rw, http.StatusNotFound, errNoLimit)
+		return
+	}
+	var v struct {
+		Down uint `json:"down"`
+		Up   uint `json:"up"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&v); err != nil {
+		apiError(rw, http.StatusBadRequest, err)
+		return
+	}
+	l.SetLimit(v.Down, v.Up)
+	logger.Printf("limit %s down %d up %d", l.Name, v.Down, v.Up)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func parseFlowQuery(req *http.Request) (q FlowQuery, err error) {
+	v := req.URL.Query()
+	q.Host = v.Get("host")
+	q.Method = v.Get("method")
+	if s := v.Get("status"); s != "" {
+		q.MinStatus, q.MaxStatus, err = parseStatusRange(s)
+		if err != nil {
+			return
+		}
+	}
+	if s := v.Get("since"); s != "" {
+		if q.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			return
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		if q.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			return
+		}
+	}
+	if s := v.Get("replayOf"); s != "" {
+		if q.ReplayOf, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// 404 或者 4xx
+func parseStatusRange(s string) (min, max int, err error) {
+	if len(s) == 3 && strings.HasSuffix(s, "xx") {
+		n, err := strconv.Atoi(s[:1])
+		if err != nil {
+			return 0, 0, err
+		}
+		return n * 100, n*100 + 99, nil
+	}
+	n, err := strconv.Atoi(s)
+	return n, n, err
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logger.Println("api write json:", err)
+	}
+}
+
+func apiError(rw http.ResponseWriter, code int, err error) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(map[string]string{"error": err.Error()})
+}
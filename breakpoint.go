@@ -0,0 +1,299 @@
+package gproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultBreakpointTimeout = 5 * time.Minute
+
+var (
+	errBreakpointNotFound = errors.New("breakpoint not found")
+	errBreakpointAction   = errors.New("unknown breakpoint action")
+	// roundTrip 不能中断连接, 返回这个错误让 proxyError 处理
+	errDropped = errors.New("dropped at breakpoint")
+)
+
+// BreakpointRule pauses matched requests or responses
+type BreakpointRule struct {
+	Name     string `json:"name,omitempty"`
+	Match    Match  `json:"match"`
+	Request  bool   `json:"request"`
+	Response bool   `json:"response"`
+}
+
+// Breakpoints keeps the paused requests and responses until they are resumed
+type Breakpoints struct {
+	// 超时之后不做修改继续, 0 使用默认值
+	Timeout time.Duration
+
+	lastID  uint64
+	mu      sync.Mutex
+	pending map[uint64]*Breakpoint
+}
+
+// Breakpoint is a paused request or response
+type Breakpoint struct {
+	ID uint64 `json:"id"`
+	// 开启 flow 记录时对应的 flow
+	FlowID uint64 `json:"flowId,omitempty"`
+	Rule   string `json:"rule,omitempty"`
+	// request 或者 response
+	Phase    string        `json:"phase"`
+	Time     time.Time     `json:"time"`
+	Request  *FlowRequest  `json:"request"`
+	Response *FlowResponse `json:"response,omitempty"`
+
+	done chan *Resume
+}
+
+// Resume is how to release a breakpoint, 零值的字段保持不变
+type Resume struct {
+	// continue, drop 或者 respond, 默认 continue
+	Action string `json:"action"`
+	// 只用于请求
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url,omitempty"`
+	// 用于响应, respond 默认 200
+	Status       int               `json:"status,omitempty"`
+	SetHeader    map[string]string `json:"setHeader,omitempty"`
+	RemoveHeader []string          `json:"removeHeader,omitempty"`
+	Body         *string           `json:"body,omitempty"`
+}
+
+// NewBreakpoints returns Breakpoints with timeout
+func NewBreakpoints(timeout time.Duration) *Breakpoints {
+	return &Breakpoints{
+		Timeout: timeout,
+		pending: make(map[uint64]*Breakpoint),
+	}
+}
+
+// Pending returns the paused breakpoints, the oldest first
+func (b *Breakpoints) Pending() []*Breakpoint {
+	b.mu.Lock()
+	bps := make([]*Breakpoint, 0, len(b.pending))
+	for _, bp := range b.pending {
+		bps = append(bps, bp)
+	}
+	b.mu.Unlock()
+	sort.Slice(bps, func(i, j int) bool { return bps[i].ID < bps[j].ID })
+	return bps
+}
+
+// Resume releases a paused breakpoint
+func (b *Breakpoints) Resume(id uint64, r *Resume) error {
+	switch r.Action {
+	case "", "continue", "drop", "respond":
+	default:
+		return errBreakpointAction
+	}
+	b.mu.Lock()
+	bp, ok := b.pending[id]
+	delete(b.pending, id)
+	b.mu.Unlock()
+	if !ok {
+		return errBreakpointNotFound
+	}
+	bp.done <- r
+	return nil
+}
+
+// pause 等待 Resume, 超时或者请求取消时返回 nil
+func (b *Breakpoints) pause(req *http.Request, bp *Breakpoint) *Resume {
+	bp.ID = atomic.AddUint64(&b.lastID, 1)
+	bp.Time = time.Now()
+	bp.done = make(chan *Resume, 1)
+	if f := flowFromContext(req.Context()); f != nil {
+		bp.FlowID = f.ID
+	}
+	b.mu.Lock()
+	b.pending[bp.ID] = bp
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.pending, bp.ID)
+		b.mu.Unlock()
+	}()
+	logger.Printf("breakpoint %d %s %s %s", bp.ID, bp.Phase, req.Method, req.URL)
+	timeout := b.Timeout
+	if timeout <= 0 {
+		timeout = defaultBreakpointTimeout
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case r := <-bp.done:
+		return r
+	case <-t.C:
+		logger.Printf("breakpoint %d timeout", bp.ID)
+	case <-req.Context().Done():
+	}
+	return nil
+}
+
+func (r *Rules) matchBreakpoint(req *http.Request) *BreakpointRule {
+	for _, rule := range r.Breakpoints {
+		if rule.Match.match(req) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// breakRequest 暂停请求, 返回非 nil 的响应时不再请求上游
+func (b *Breakpoints) breakRequest(req *http.Request, rule *BreakpointRule) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	r := b.pause(req, &Breakpoint{
+		Rule:  rule.Name,
+		Phase: "request",
+		Request: &FlowRequest{
+			Method:   req.Method,
+			URL:      req.URL.String(),
+			Proto:    req.Proto,
+			Header:   cloneHeader(req.Header),
+			Body:     body,
+			BodySize: int64(len(body)),
+		},
+	})
+	if r == nil {
+		return nil, req.Context().Err()
+	}
+	switch r.Action {
+	case "drop":
+		return nil, dropFlow(req)
+	case "respond":
+		res := &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Request:    req,
+		}
+		r.applyResponse(res, nil)
+		return res, nil
+	}
+	return nil, r.applyRequest(req)
+}
+
+// breakResponse 暂停响应, 返回修改后或者合成的响应
+func (b *Breakpoints) breakResponse(res *http.Response, rule *BreakpointRule) (*http.Response, error) {
+	req := res.Request
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	// 解压之后才方便修改
+	if decoded, err := decodeBody(res.Header.Get("Content-Encoding"), body); err == nil {
+		body = decoded
+		res.Header.Del("Content-Encoding")
+	}
+	setResponseBody(res, body)
+	r := b.pause(req, &Breakpoint{
+		Rule:  rule.Name,
+		Phase: "response",
+		Request: &FlowRequest{
+			Method: req.Method,
+			URL:    req.URL.String(),
+			Proto:  req.Proto,
+			Header: cloneHeader(req.Header),
+		},
+		Response: &FlowResponse{
+			StatusCode: res.StatusCode,
+			Proto:      res.Proto,
+			Header:     cloneHeader(res.Header),
+			Body:       body,
+			BodySize:   int64(len(body)),
+		},
+	})
+	if r == nil {
+		if err := req.Context().Err(); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	switch r.Action {
+	case "drop":
+		return nil, dropFlow(req)
+	case "respond":
+		res.StatusCode = http.StatusOK
+		res.Header = make(http.Header)
+		r.applyResponse(res, nil)
+		return res, nil
+	}
+	r.applyResponse(res, body)
+	return res, nil
+}
+
+func (r *Resume) applyRequest(req *http.Request) error {
+	if r.Method != "" {
+		req.Method = r.Method
+	}
+	if r.URL != "" {
+		u, err := url.Parse(r.URL)
+		if err != nil {
+			return err
+		}
+		if u.Host != req.URL.Host {
+			req.Host = ""
+		}
+		req.URL = u
+	}
+	for _, k := range r.RemoveHeader {
+		req.Header.Del(k)
+	}
+	for k, v := range r.SetHeader {
+		req.Header.Set(k, v)
+	}
+	if r.Body != nil {
+		body := []byte(*r.Body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		req.Header.Del("Transfer-Encoding")
+	}
+	return nil
+}
+
+func (r *Resume) applyResponse(res *http.Response, body []byte) {
+	if r.Status != 0 {
+		res.StatusCode = r.Status
+	}
+	res.Status = fmt.Sprintf("%d %s", res.StatusCode, http.StatusText(res.StatusCode))
+	for _, k := range r.RemoveHeader {
+		res.Header.Del(k)
+	}
+	for k, v := range r.SetHeader {
+		res.Header.Set(k, v)
+	}
+	if r.Body != nil {
+		body = []byte(*r.Body)
+	}
+	setResponseBody(res, body)
+}
+
+// dropFlow 返回 errDropped, 由 proxyError 断开客户端的连接
+func dropFlow(req *http.Request) error {
+	logger.Printf("breakpoint drop %s %s", req.Method, req.URL)
+	return errDropped
+}
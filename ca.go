@@ -0,0 +1,62 @@
+package gproxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+)
+
+var errCA = errors.New("invalid ca cert file")
+
+// 浏览器不接受有效期太长的证书, 按需签发的证书只用一年
+const leafYears = 1
+
+// CA signs leaf certificates for intercepted hosts
+type CA struct {
+	cert tls.Certificate
+	x509 *x509.Certificate
+}
+
+// LoadCA loads a root ca created by CreateRootCert
+func LoadCA(certFile, keyFile string) (*CA, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !x509Cert.IsCA {
+		return nil, errCA
+	}
+	return &CA{cert: cert, x509: x509Cert}, nil
+}
+
+// Sign creates a leaf certificate for host
+func (ca *CA) Sign(host string) (*tls.Certificate, error) {
+	pri, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	derBytes, err := signCert(pkix.Name{
+		CommonName:   host,
+		Organization: ca.x509.Subject.Organization,
+	}, pri, &ca.cert, []string{host}, leafYears)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		// 带上ca证书,客户端可以校验完整的链
+		Certificate: [][]byte{derBytes, ca.cert.Certificate[0]},
+		PrivateKey:  pri,
+		Leaf:        leaf,
+	}, nil
+}
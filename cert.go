@@ -34,6 +34,16 @@ func CreateSignCert(
 	priv interface{},
 	ca *tls.Certificate,
 	hosts []string) (derBytes []byte, err error) {
+	return signCert(subject, priv, ca, hosts, 10)
+}
+
+// signCert 签发有效期为 years 年的证书
+func signCert(
+	subject pkix.Name,
+	priv interface{},
+	ca *tls.Certificate,
+	hosts []string,
+	years int) (derBytes []byte, err error) {
 	sn, err := serialNumber()
 	if err != nil {
 		return
@@ -43,7 +53,7 @@ func CreateSignCert(
 		SerialNumber: sn,
 		Subject:      subject,
 		NotBefore:    notBefore,
-		NotAfter:     notBefore.AddDate(10, 0, 0),
+		NotAfter:     notBefore.AddDate(years, 0, 0),
 		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		KeyUsage:     x509.KeyUsageDigitalSignature,
 	}
@@ -0,0 +1,212 @@
+package gproxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCertStoreSize = 1024
+	defaultRenewBefore   = 7 * 24 * time.Hour
+)
+
+// CertStore caches leaf certificates signed by CA,
+// 内存里是一个 LRU, 设置了 Dir 之后会同时保存到磁盘
+type CertStore struct {
+	CA *CA
+	// 内存里最多缓存的证书数量, 0 使用默认值
+	Size int
+	// 证书保存目录, 为空则只缓存在内存
+	Dir string
+	// 证书过期前多久重新签发, 0 使用默认值
+	RenewBefore time.Duration
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	calls map[string]*certCall
+}
+
+type certEntry struct {
+	host string
+	cert *tls.Certificate
+}
+
+// 同一个 host 同时只签发一次
+type certCall struct {
+	wg   sync.WaitGroup
+	cert *tls.Certificate
+	err  error
+}
+
+// NewCertStore returns a memory only CertStore
+func NewCertStore(ca *CA) *CertStore {
+	return &CertStore{CA: ca}
+}
+
+// Get returns certificate for host, signs a new one if missing or about to expire
+func (s *CertStore) Get(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+	s.mu.Lock()
+	if s.items == nil {
+		s.ll = list.New()
+		s.items = make(map[string]*list.Element)
+		s.calls = make(map[string]*certCall)
+	}
+	if e, ok := s.items[host]; ok {
+		cert := e.Value.(*certEntry).cert
+		if s.valid(cert) {
+			s.ll.MoveToFront(e)
+			s.mu.Unlock()
+			return cert, nil
+		}
+		s.removeElement(e)
+	}
+	if c, ok := s.calls[host]; ok {
+		s.mu.Unlock()
+		c.wg.Wait()
+		return c.cert, c.err
+	}
+	c := new(certCall)
+	c.wg.Add(1)
+	s.calls[host] = c
+	s.mu.Unlock()
+
+	c.cert, c.err = s.load(host)
+	c.wg.Done()
+
+	s.mu.Lock()
+	delete(s.calls, host)
+	if c.err == nil {
+		s.add(host, c.cert)
+	}
+	s.mu.Unlock()
+	return c.cert, c.err
+}
+
+// Remove removes certificate for host from memory and disk
+func (s *CertStore) Remove(host string) {
+	host = strings.ToLower(host)
+	s.mu.Lock()
+	if e, ok := s.items[host]; ok {
+		s.removeElement(e)
+	}
+	s.mu.Unlock()
+	if s.Dir != "" {
+		os.Remove(s.filename(host))
+	}
+}
+
+// Len returns the number of certificates in memory
+func (s *CertStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ll == nil {
+		return 0
+	}
+	return s.ll.Len()
+}
+
+func (s *CertStore) add(host string, cert *tls.Certificate) {
+	s.items[host] = s.ll.PushFront(&certEntry{host: host, cert: cert})
+	size := s.Size
+	if size <= 0 {
+		size = defaultCertStoreSize
+	}
+	for s.ll.Len() > size {
+		s.removeElement(s.ll.Back())
+	}
+}
+
+func (s *CertStore) removeElement(e *list.Element) {
+	s.ll.Remove(e)
+	delete(s.items, e.Value.(*certEntry).host)
+}
+
+func (s *CertStore) valid(cert *tls.Certificate) bool {
+	d := s.RenewBefore
+	if d <= 0 {
+		d = defaultRenewBefore
+	}
+	return time.Now().Add(d).Before(cert.Leaf.NotAfter)
+}
+
+// 先从磁盘读取, 没有或者快过期了再签发
+func (s *CertStore) load(host string) (*tls.Certificate, error) {
+	if s.Dir != "" {
+		cert, err := s.readFile(host)
+		if err == nil && s.valid(cert) && cert.Leaf.CheckSignatureFrom(s.CA.x509) == nil {
+			return cert, nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			logger.Printf("read cert %s failed %s \n", host, err)
+		}
+	}
+	logger.Printf("sign cert %s \n", host)
+	cert, err := s.CA.Sign(host)
+	if err != nil {
+		return nil, err
+	}
+	if s.Dir != "" {
+		if err := s.writeFile(host, cert); err != nil {
+			logger.Printf("write cert %s failed %s \n", host, err)
+		}
+	}
+	return cert, nil
+}
+
+// 文件名里不能有 ':' (ipv6) 和 '*'
+func (s *CertStore) filename(host string) string {
+	name := strings.NewReplacer(":", "_", "*", "_", "/", "_").Replace(host)
+	return filepath.Join(s.Dir, name+".pem")
+}
+
+func (s *CertStore) readFile(host string) (*tls.Certificate, error) {
+	data, err := ioutil.ReadFile(s.filename(host))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// 证书链和私钥写到同一个文件
+func (s *CertStore) writeFile(host string, cert *tls.Certificate) error {
+	pri, ok := cert.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return errCert
+	}
+	var buf bytes.Buffer
+	for _, der := range cert.Certificate {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	pem.Encode(&buf, &pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(pri)})
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	// 先写临时文件再 rename, 避免读到一半的文件
+	tmp := s.filename(host) + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.filename(host))
+}
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/urfave/cli"
 	gp "github.com/xiilei/gproxy"
@@ -16,17 +24,39 @@ func main() {
 	app.Name = "gproxy"
 	app.HelpName = "gproxy"
 	app.Usage = "a simple http/https proxy"
-	app.Version = "0.1.0"
+	app.Version = gp.Version
 	app.Action = run
 	app.Flags = []cli.Flag{
 		cli.StringFlag{Name: "addr", Usage: "listen port", Value: ":8080"},
 		cli.StringSliceFlag{Name: "host", Usage: "https host"},
 		cli.StringFlag{Name: "cert", Usage: "cert file for https host"},
 		cli.StringFlag{Name: "key", Usage: "key file for https host"},
+		cli.StringFlag{Name: "cacert", Usage: "ca cert file, sign cert for every https host"},
+		cli.StringFlag{Name: "cakey", Usage: "ca key file, sign cert for every https host"},
+		cli.StringFlag{Name: "certdir", Usage: "dir to save signed certs"},
+		cli.IntFlag{Name: "certsize", Usage: "max signed certs in memory", Value: 1024},
+		cli.IntFlag{Name: "flows", Usage: "max captured flows, 0 disable capture"},
+		cli.IntFlag{Name: "h2view", Usage: "keep http2 frames of the last n intercepted connections, 0 disable"},
+		cli.StringFlag{Name: "api", Usage: "control api listen address"},
+		cli.StringFlag{Name: "rules", Usage: "request/response rules file"},
+		cli.DurationFlag{Name: "breakpoint-timeout", Usage: "continue paused breakpoints after timeout", Value: 5 * time.Minute},
+		cli.StringFlag{Name: "profile", Usage: "network profile: 2g, 3g, 4g, wifi-lossy"},
+		cli.StringFlag{Name: "scripts", Usage: "dir of javascript hooks, reloaded on change"},
+		cli.StringFlag{Name: "snapshot", Usage: "answer requests from a recorded har file"},
+		cli.BoolFlag{Name: "snapshot-pass", Usage: "pass snapshot missed requests to upstream"},
+		cli.BoolFlag{Name: "snapshot-body", Usage: "match request body in snapshot"},
+		cli.BoolFlag{Name: "snapshot-nomethod", Usage: "ignore request method in snapshot"},
+		cli.BoolFlag{Name: "snapshot-noquery", Usage: "ignore query string in snapshot"},
+		cli.StringSliceFlag{Name: "snapshot-ignore", Usage: "ignore query param in snapshot"},
+		cli.StringFlag{Name: "socks", Usage: "socks5 listen address"},
+		cli.StringSliceFlag{Name: "socks-user", Usage: "socks5 user, name:password"},
+		cli.StringFlag{Name: "har", Usage: "write captured flows to a har file on exit"},
+		cli.DurationFlag{Name: "shutdown-timeout", Usage: "wait for active connections on SIGINT/SIGTERM", Value: 10 * time.Second},
 	}
 	app.Commands = []cli.Command{
 		certCmd,
 		pureCmd,
+		reverseCmd,
 	}
 	err := app.Run(os.Args)
 	if err != nil {
@@ -44,6 +74,182 @@ func run(ctx *cli.Context) error {
 			return err
 		}
 	}
-	logger.Printf("listen at %s\n", ctx.String("addr"))
-	return http.ListenAndServe(ctx.String("addr"), proxy)
+	if ctx.IsSet("cacert") && ctx.IsSet("cakey") {
+		err := proxy.SetCA(ctx.String("cacert"), ctx.String("cakey"))
+		if err != nil {
+			return err
+		}
+		proxy.Certs.Dir = ctx.String("certdir")
+		proxy.Certs.Size = ctx.Int("certsize")
+	}
+	if file := ctx.String("rules"); file != "" {
+		rules, err := gp.LoadRules(file)
+		if err != nil {
+			return err
+		}
+		proxy.Rules = rules
+		if len(rules.Breakpoints) > 0 {
+			proxy.Breakpoints = gp.NewBreakpoints(ctx.Duration("breakpoint-timeout"))
+		}
+	}
+	// 在 listener 上模拟网络, 包括建立连接的延迟
+	var profile *gp.NetworkProfile
+	if name := ctx.String("profile"); name != "" {
+		p, err := gp.LookupProfile(name)
+		if err != nil {
+			return err
+		}
+		profile = p
+	}
+	if dir := ctx.String("scripts"); dir != "" {
+		scripts, err := gp.LoadScripts(dir)
+		if err != nil {
+			return err
+		}
+		go scripts.Watch(time.Second)
+		proxy.Scripts = scripts
+	}
+	if file := ctx.String("snapshot"); file != "" {
+		s, err := gp.LoadSnapshot(file, gp.SnapshotMatch{
+			IgnoreMethod: ctx.Bool("snapshot-nomethod"),
+			IgnoreQuery:  ctx.Bool("snapshot-noquery"),
+			IgnoreParams: ctx.StringSlice("snapshot-ignore"),
+			Body:         ctx.Bool("snapshot-body"),
+		})
+		if err != nil {
+			return err
+		}
+		s.Fallthrough = ctx.Bool("snapshot-pass")
+		proxy.Snapshot = s
+		logger.Printf("snapshot %s %d requests\n", file, s.Len())
+	}
+	size := ctx.Int("flows")
+	if size == 0 && (ctx.IsSet("api") || ctx.IsSet("har")) {
+		size = 1000
+	}
+	if size > 0 {
+		proxy.Flows = gp.NewFlowStore(size)
+	}
+	if n := ctx.Int("h2view"); n > 0 {
+		proxy.H2View = &gp.H2View{Size: n}
+	}
+	if addr := ctx.String("api"); addr != "" {
+		go serveAPI(addr, proxy)
+	}
+	var socks *gp.SOCKS5
+	if addr := ctx.String("socks"); addr != "" {
+		socks = &gp.SOCKS5{Proxy: proxy, ReadTimeout: 30 * time.Second}
+		for _, u := range ctx.StringSlice("socks-user") {
+			i := strings.IndexByte(u, ':')
+			if i < 0 {
+				return fmt.Errorf("invalid socks user %q, must be name:password", u)
+			}
+			if socks.Users == nil {
+				socks.Users = make(map[string]string)
+			}
+			socks.Users[u[:i]] = u[i+1:]
+		}
+		go serveSOCKS(addr, socks, profile)
+	}
+	srv := &http.Server{Addr: ctx.String("addr"), Handler: proxy}
+	ln, err := listen(srv.Addr, profile)
+	if err != nil {
+		return err
+	}
+	logger.Printf("listen at %s\n", srv.Addr)
+	err = serveUntilSignal(func() error { return srv.Serve(ln) }, ctx.Duration("shutdown-timeout"), func(c context.Context) {
+		var wg sync.WaitGroup
+		// http.Server 不等待 hijack 的连接, 由 proxy 处理
+		shutdowns := []func(context.Context) error{srv.Shutdown, proxy.Shutdown}
+		if socks != nil {
+			shutdowns = append(shutdowns, socks.Shutdown)
+		}
+		for _, shutdown := range shutdowns {
+			wg.Add(1)
+			go func(shutdown func(context.Context) error) {
+				defer wg.Done()
+				if err := shutdown(c); err != nil {
+					logger.Println("shutdown:", err)
+				}
+			}(shutdown)
+		}
+		wg.Wait()
+	})
+	if file := ctx.String("har"); file != "" && proxy.Flows != nil {
+		if werr := writeHAR(file, proxy.Flows); werr != nil {
+			logger.Println("har:", werr)
+		}
+	}
+	return err
+}
+
+// serveUntilSignal 收到 SIGINT/SIGTERM 之后调用 shutdown, 再收到一次时不再等待
+func serveUntilSignal(serve func() error, timeout time.Duration, shutdown func(context.Context)) error {
+	errc := make(chan error, 1)
+	go func() { errc <- serve() }()
+	sigc := make(chan os.Signal, 2)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-sigc:
+		logger.Printf("%s, shutting down, wait at most %s\n", sig, timeout)
+	}
+	c, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-sigc:
+			cancel()
+		case <-c.Done():
+		}
+	}()
+	shutdown(c)
+	return nil
+}
+
+func writeHAR(file string, store *gp.FlowStore) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	flows := store.Query(gp.FlowQuery{})
+	if err := gp.ExportHAR(f, flows); err != nil {
+		f.Close()
+		return err
+	}
+	logger.Printf("har %s %d flows\n", file, len(flows))
+	return f.Close()
+}
+
+// listen 监听 addr, profile 不为 nil 时模拟网络
+func listen(addr string, profile *gp.NetworkProfile) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if profile != nil {
+		ln = profile.Listener(ln)
+	}
+	return ln, nil
+}
+
+func serveSOCKS(addr string, socks *gp.SOCKS5, profile *gp.NetworkProfile) {
+	ln, err := listen(addr, profile)
+	if err != nil {
+		logger.Println("socks5:", err)
+		return
+	}
+	logger.Printf("socks5 listen at %s\n", addr)
+	if err := socks.Serve(ln); err != nil {
+		logger.Println("socks5:", err)
+	}
+}
+
+func serveAPI(addr string, proxy *gp.ProxyHandler) {
+	logger.Printf("api listen at %s\n", addr)
+	if err := http.ListenAndServe(addr, gp.NewAPI(proxy)); err != nil {
+		logger.Println("api:", err)
+	}
 }
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"time"
+
 	"github.com/urfave/cli"
 	gp "github.com/xiilei/gproxy"
 )
@@ -10,15 +13,38 @@ var pureCmd = cli.Command{
 	Usage: "pure http proxy",
 	Flags: []cli.Flag{
 		cli.StringFlag{Name: "addr", Usage: "listen port", Value: ":8080"},
+		cli.StringFlag{Name: "profile", Usage: "network profile: 2g, 3g, 4g, wifi-lossy"},
+		cli.StringFlag{Name: "rules", Usage: "rules file, only limits are used"},
+		cli.DurationFlag{Name: "shutdown-timeout", Usage: "wait for active connections on SIGINT/SIGTERM", Value: 10 * time.Second},
 	},
 	Action: func(ctx *cli.Context) error {
-		return pureRun(ctx.String("addr"))
+		return pureRun(ctx.String("addr"), ctx.String("profile"), ctx.String("rules"), ctx.Duration("shutdown-timeout"))
 	},
 	ArgsUsage: "",
 }
 
-func pureRun(addr string) error {
+func pureRun(addr, profile, rules string, timeout time.Duration) error {
 	p := gp.PureProxy{}
+	if profile != "" {
+		np, err := gp.LookupProfile(profile)
+		if err != nil {
+			return err
+		}
+		p.Profile = np
+	}
+	if rules != "" {
+		r, err := gp.LoadRules(rules)
+		if err != nil {
+			return err
+		}
+		p.Limits = r.Limits
+	}
 	logger.Printf("listen at %s\n", addr)
-	return p.ListenAndServe(addr)
+	return serveUntilSignal(func() error {
+		return p.ListenAndServe(addr)
+	}, timeout, func(c context.Context) {
+		if err := p.Shutdown(c); err != nil {
+			logger.Println("shutdown:", err)
+		}
+	})
 }
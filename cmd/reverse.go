@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/urfave/cli"
+	gp "github.com/xiilei/gproxy"
+)
+
+var reverseCmd = cli.Command{
+	Name:  "reverse",
+	Usage: "reverse proxy to weighted backend pools",
+	Flags: []cli.Flag{
+		cli.StringFlag{Name: "addr", Usage: "listen port", Value: ":8080"},
+		cli.StringFlag{Name: "config", Usage: "pools and routes config file"},
+		cli.StringFlag{Name: "api", Usage: "health status listen address"},
+	},
+	Action: func(ctx *cli.Context) error {
+		return reverseRun(ctx.String("addr"), ctx.String("config"), ctx.String("api"))
+	},
+	ArgsUsage: "",
+}
+
+func reverseRun(addr, file, api string) error {
+	if file == "" {
+		return errors.New("must specify a config file")
+	}
+	config, err := gp.LoadReverseConfig(file)
+	if err != nil {
+		return err
+	}
+	h, err := gp.NewReverseHandler(config)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	if api != "" {
+		go serveStatus(api, h)
+	}
+	logger.Printf("reverse listen at %s\n", addr)
+	return http.ListenAndServe(addr, h)
+}
+
+func serveStatus(addr string, h *gp.ReverseHandler) {
+	mux := http.NewServeMux()
+	mux.Handle("/pools", h.StatusHandler())
+	logger.Printf("api listen at %s\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Println("api:", err)
+	}
+}
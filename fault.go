@@ -0,0 +1,247 @@
+package gproxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errFault = errors.New("fault injected")
+
+// FaultRule makes the proxy misbehave on purpose
+//
+//	reset    写给客户端 After 字节之后发送 TCP RST
+//	truncate 写给客户端 After 字节之后关闭连接
+//	stall    写给客户端 After 字节之后暂停 Duration
+//	status   不请求上游, 直接返回 Status, 可以带上 Retry-After
+//	corrupt  修改 After 字节之后第一个 tls application data 记录, 只用于 CONNECT 连接
+type FaultRule struct {
+	Name  string `json:"name,omitempty"`
+	Match Match  `json:"match"`
+	Fault string `json:"fault"`
+	// 触发的概率, 0 总是触发
+	Probability float64  `json:"probability,omitempty"`
+	After       int64    `json:"after,omitempty"`
+	Duration    Duration `json:"duration,omitempty"`
+	Status      int      `json:"status,omitempty"`
+	RetryAfter  Duration `json:"retryAfter,omitempty"`
+}
+
+func (f *FaultRule) compile() error {
+	switch f.Fault {
+	case "reset", "truncate", "stall", "corrupt":
+	case "status":
+		if f.Status == 0 {
+			f.Status = http.StatusServiceUnavailable
+		}
+	default:
+		return fmt.Errorf("fault %s: unknown fault %q", f.Name, f.Fault)
+	}
+	return f.Match.compile()
+}
+
+func (f *FaultRule) hit() bool {
+	return f.Probability <= 0 || f.Probability >= 1 || rand.Float64() < f.Probability
+}
+
+// matchFault 返回第一个匹配并且命中概率的规则
+func (r *Rules) matchFault(req *http.Request, ok func(*FaultRule) bool) *FaultRule {
+	for _, f := range r.Faults {
+		if ok(f) && f.Match.match(req) && f.hit() {
+			return f
+		}
+	}
+	return nil
+}
+
+// serveStatus 直接返回错误状态
+func (f *FaultRule) serveStatus(rw http.ResponseWriter, req *http.Request) {
+	logger.Printf("fault %s %d %s", f.Name, f.Status, req.URL)
+	if d := time.Duration(f.RetryAfter); d > 0 {
+		rw.Header().Set("Retry-After", strconv.Itoa(int((d+time.Second-1)/time.Second)))
+	}
+	http.Error(rw, fmt.Sprintf("%d %s", f.Status, http.StatusText(f.Status)), f.Status)
+}
+
+// faultWriter 用于 http 响应, 在写出 After 字节之后触发
+type faultWriter struct {
+	http.ResponseWriter
+	req   *http.Request
+	fault *FaultRule
+	n     int64
+	done  bool
+	// 触发了 reset/truncate, 之后的 Write 都返回 errFault, 由 handler 中断连接
+	aborted bool
+}
+
+func (w *faultWriter) Write(p []byte) (int, error) {
+	if w.aborted {
+		return 0, errFault
+	}
+	if w.done || w.n+int64(len(p)) <= w.fault.After {
+		n, err := w.ResponseWriter.Write(p)
+		w.n += int64(n)
+		return n, err
+	}
+	k := w.fault.After - w.n
+	n, err := w.ResponseWriter.Write(p[:k])
+	w.n += int64(n)
+	if err != nil {
+		return n, err
+	}
+	w.done = true
+	rc := http.NewResponseController(w.ResponseWriter)
+	rc.Flush()
+	logger.Printf("fault %s %s after %d bytes %s", w.fault.Name, w.fault.Fault, w.n, w.req.URL)
+	if w.fault.Fault == "stall" {
+		if err := sleep(w.req.Context(), time.Duration(w.fault.Duration)); err != nil {
+			return n, err
+		}
+		m, err := w.ResponseWriter.Write(p[k:])
+		return n + m, err
+	}
+	if f := flowFromContext(w.req.Context()); f != nil {
+		f.Error = errFault.Error()
+	}
+	if w.fault.Fault == "reset" {
+		// h2 不能 Hijack, 只能 reset stream
+		if conn, _, err := rc.Hijack(); err == nil {
+			resetConn(conn)
+		}
+	}
+	w.aborted = true
+	return n, errFault
+}
+
+// abort 在 handler 返回之前调用, 触发过的连接不能正常结束
+func (w *faultWriter) abort() {
+	if w.aborted {
+		// http.Server 关闭连接, h2 reset stream
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (w *faultWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *faultWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// faultConn 用于 CONNECT 连接, 统计写给客户端的字节
+type faultConn struct {
+	net.Conn
+	fault *FaultRule
+	addr  string
+
+	mu   sync.Mutex
+	n    int64
+	done bool
+	// 解析 tls 记录, 用于 corrupt
+	hdr    [5]byte
+	hdrN   int
+	recLen int
+}
+
+func newFaultConn(c net.Conn, f *FaultRule, addr string) net.Conn {
+	return &faultConn{Conn: c, fault: f, addr: addr}
+}
+
+func (c *faultConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return c.Conn.Write(p)
+	}
+	if c.fault.Fault == "corrupt" {
+		return c.corrupt(p)
+	}
+	if c.n+int64(len(p)) <= c.fault.After {
+		n, err := c.Conn.Write(p)
+		c.n += int64(n)
+		return n, err
+	}
+	k := c.fault.After - c.n
+	n, err := c.Conn.Write(p[:k])
+	c.n += int64(n)
+	if err != nil {
+		return n, err
+	}
+	c.done = true
+	logger.Printf("fault %s %s after %d bytes %s", c.fault.Name, c.fault.Fault, c.n, c.addr)
+	switch c.fault.Fault {
+	case "stall":
+		time.Sleep(time.Duration(c.fault.Duration))
+		m, err := c.Conn.Write(p[k:])
+		return n + m, err
+	case "reset":
+		resetConn(c.Conn)
+	default:
+		c.Conn.Close()
+	}
+	return n, errFault
+}
+
+// corrupt 修改 After 之后第一个 application data 记录的第一个字节, 客户端会收到 bad_record_mac
+func (c *faultConn) corrupt(p []byte) (int, error) {
+	var q []byte
+	for i := 0; i < len(p) && !c.done; i++ {
+		if c.hdrN < len(c.hdr) {
+			c.hdr[c.hdrN] = p[i]
+			c.hdrN++
+			if c.hdrN == len(c.hdr) {
+				c.recLen = int(c.hdr[3])<<8 | int(c.hdr[4])
+				if c.recLen == 0 {
+					c.hdrN = 0
+				}
+			}
+			continue
+		}
+		// 23 是 application data
+		if c.hdr[0] == 23 && c.n+int64(i) >= c.fault.After {
+			q = append([]byte(nil), p...)
+			q[i] ^= 0xff
+			c.done = true
+			logger.Printf("fault %s corrupt tls record after %d bytes %s", c.fault.Name, c.n+int64(i), c.addr)
+			break
+		}
+		c.recLen--
+		if c.recLen <= 0 {
+			c.hdrN = 0
+		}
+	}
+	if q == nil {
+		q = p
+	}
+	n, err := c.Conn.Write(q)
+	c.n += int64(n)
+	return n, err
+}
+
+// resetConn 关闭连接时发送 RST 而不是 FIN
+func resetConn(c net.Conn) {
+	for {
+		if tc, ok := c.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+			break
+		}
+		nc, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		c = nc.NetConn()
+	}
+	c.Close()
+}
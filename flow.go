@@ -0,0 +1,357 @@
+package gproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const defaultMaxBodySize = 1 << 20
+
+// Flow is a captured request and its response
+type Flow struct {
+	ID       uint64        `json:"id"`
+	Request  *FlowRequest  `json:"request"`
+	Response *FlowResponse `json:"response,omitempty"`
+	Conn     ConnInfo      `json:"conn"`
+	Timings  Timings       `json:"timings"`
+	Error    string        `json:"error,omitempty"`
+	// 升级成 websocket 之后的 frame
+	WebSocket *WebSocket `json:"websocket,omitempty"`
+	// 重放的请求记录原始 flow 的 id
+	ReplayOf uint64 `json:"replayOf,omitempty"`
+}
+
+// FlowRequest is the captured request
+type FlowRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Proto  string      `json:"proto"`
+	Header http.Header `json:"header"`
+	// 只保存 Body 的前 MaxBodySize 字节, BodySize 是实际大小
+	Body     []byte `json:"body,omitempty"`
+	BodySize int64  `json:"bodySize"`
+}
+
+// FlowResponse is the captured response
+type FlowResponse struct {
+	StatusCode int         `json:"status"`
+	Proto      string      `json:"proto"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body,omitempty"`
+	BodySize   int64       `json:"bodySize"`
+}
+
+// ConnInfo is the client and upstream connection of a flow
+type ConnInfo struct {
+	ClientAddr string   `json:"clientAddr"`
+	ClientTLS  *TLSInfo `json:"clientTLS,omitempty"`
+	ServerAddr string   `json:"serverAddr,omitempty"`
+	ServerTLS  *TLSInfo `json:"serverTLS,omitempty"`
+	// 复用了 Transport 里的连接
+	Reused bool `json:"reused"`
+}
+
+// TLSInfo is the negotiated parameters of a tls connection
+type TLSInfo struct {
+	Version            uint16 `json:"version"`
+	CipherSuite        uint16 `json:"cipherSuite"`
+	ServerName         string `json:"serverName,omitempty"`
+	NegotiatedProtocol string `json:"negotiatedProtocol,omitempty"`
+}
+
+// Timings of a flow, 没有发生的阶段为 -1
+type Timings struct {
+	Start   time.Time     `json:"start"`
+	End     time.Time     `json:"end"`
+	DNS     time.Duration `json:"dns"`
+	Connect time.Duration `json:"connect"`
+	TLS     time.Duration `json:"tls"`
+	Send    time.Duration `json:"send"`
+	Wait    time.Duration `json:"wait"`
+	Receive time.Duration `json:"receive"`
+}
+
+// Host returns the hostname of request url
+func (f *Flow) Host() string {
+	if f.Request == nil {
+		return ""
+	}
+	if u, err := url.Parse(f.Request.URL); err == nil {
+		return u.Hostname()
+	}
+	return ""
+}
+
+func newTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	if state == nil {
+		return nil
+	}
+	return &TLSInfo{
+		Version:            state.Version,
+		CipherSuite:        state.CipherSuite,
+		ServerName:         state.ServerName,
+		NegotiatedProtocol: state.NegotiatedProtocol,
+	}
+}
+
+type flowKey struct{}
+
+func flowFromContext(ctx context.Context) *Flow {
+	f, _ := ctx.Value(flowKey{}).(*Flow)
+	return f
+}
+
+// capture 在请求的生命周期里收集 Flow 的各项数据
+type capture struct {
+	flow   *Flow
+	reqBuf limitedBuffer
+	resBuf limitedBuffer
+
+	mu                         sync.Mutex
+	dnsStart, connStart        time.Time
+	tlsStart, gotConn, wrote   time.Time
+	firstByte                  time.Time
+	dns, connect, tlsHandshake time.Duration
+}
+
+func newCapture(id uint64, req *http.Request, max int64) *capture {
+	c := &capture{
+		flow: &Flow{
+			ID: id,
+			Request: &FlowRequest{
+				Method: req.Method,
+				URL:    req.URL.String(),
+				Proto:  req.Proto,
+				Header: cloneHeader(req.Header),
+			},
+			Conn: ConnInfo{
+				ClientAddr: req.RemoteAddr,
+				ClientTLS:  newTLSInfo(req.TLS),
+			},
+			Timings: Timings{Start: time.Now()},
+		},
+		dns:          -1,
+		connect:      -1,
+		tlsHandshake: -1,
+	}
+	c.reqBuf.max = max
+	c.resBuf.max = max
+	return c
+}
+
+// wrap 记录请求 body, 并在 context 里加上 Flow 和 httptrace
+func (c *capture) wrap(req *http.Request) *http.Request {
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &teeBody{ReadCloser: req.Body, w: &c.reqBuf}
+	}
+	ctx := context.WithValue(req.Context(), flowKey{}, c.flow)
+	ctx = httptrace.WithClientTrace(ctx, c.trace())
+	return req.WithContext(ctx)
+}
+
+func (c *capture) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			c.mu.Lock()
+			c.dnsStart = time.Now()
+			c.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			c.mu.Lock()
+			c.dns = time.Since(c.dnsStart)
+			c.mu.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			c.mu.Lock()
+			c.connStart = time.Now()
+			c.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			c.mu.Lock()
+			c.connect = time.Since(c.connStart)
+			c.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			c.mu.Lock()
+			c.tlsStart = time.Now()
+			c.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			c.mu.Lock()
+			c.tlsHandshake = time.Since(c.tlsStart)
+			c.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.gotConn = time.Now()
+			c.flow.Conn.Reused = info.Reused
+			if info.Conn == nil {
+				return
+			}
+			c.flow.Conn.ServerAddr = info.Conn.RemoteAddr().String()
+			if tc, ok := info.Conn.(*tls.Conn); ok {
+				state := tc.ConnectionState()
+				c.flow.Conn.ServerTLS = newTLSInfo(&state)
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			c.mu.Lock()
+			c.wrote = time.Now()
+			c.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			c.mu.Lock()
+			c.firstByte = time.Now()
+			c.mu.Unlock()
+		},
+	}
+}
+
+func (c *capture) finish(status int, header http.Header) *Flow {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.flow
+	t := &f.Timings
+	t.End = time.Now()
+	t.DNS, t.Connect, t.TLS = c.dns, c.connect, c.tlsHandshake
+	t.Send, t.Wait, t.Receive = -1, -1, -1
+	if !c.gotConn.IsZero() && !c.wrote.IsZero() {
+		t.Send = c.wrote.Sub(c.gotConn)
+	}
+	if !c.wrote.IsZero() && !c.firstByte.IsZero() {
+		t.Wait = c.firstByte.Sub(c.wrote)
+		t.Receive = t.End.Sub(c.firstByte)
+	}
+	f.Request.Body = c.reqBuf.Bytes()
+	f.Request.BodySize = c.reqBuf.n
+	if status != 0 {
+		f.Response = &FlowResponse{
+			StatusCode: status,
+			Proto:      f.Request.Proto,
+			Header:     header,
+			Body:       c.resBuf.Bytes(),
+			BodySize:   c.resBuf.n,
+		}
+	}
+	return f
+}
+
+// captureWriter 记录写给客户端的响应
+type captureWriter struct {
+	http.ResponseWriter
+	c      *capture
+	status int
+	header http.Header
+	// flow 只加一次, 升级的连接在 Hijack 时就加入
+	store *FlowStore
+	once  sync.Once
+}
+
+// add 结束记录, 把 flow 加到 store
+func (w *captureWriter) add() {
+	w.once.Do(func() {
+		w.store.Add(w.c.finish(w.status, w.header))
+	})
+}
+
+func (w *captureWriter) WriteHeader(code int) {
+	// 1xx 之后还会有最终的响应
+	if w.status == 0 && code >= 200 || code == http.StatusSwitchingProtocols {
+		w.status = code
+		w.header = cloneHeader(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.c.resBuf.Write(p[:n])
+	return n, err
+}
+
+func (w *captureWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *captureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errHijack
+	}
+	conn, brw, err := hj.Hijack()
+	if err == nil {
+		// 升级之后的连接可能一直不关闭, 先把 flow 加到 store, WebSocket 继续记录 frame
+		w.add()
+	}
+	return conn, brw, err
+}
+
+func (w *captureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+var errHijack = errors.New("hijacking not support")
+
+type teeBody struct {
+	io.ReadCloser
+	w io.Writer
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		t.w.Write(p[:n])
+	}
+	return n, err
+}
+
+// limitedBuffer 只保存前 max 个字节, n 是写入的总字节数
+type limitedBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+	max int64
+	n   int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(p)
+	b.n += int64(n)
+	if room := b.max - int64(len(b.buf)); room > 0 {
+		if int64(len(p)) > room {
+			p = p[:room]
+		}
+		b.buf = append(b.buf, p...)
+	}
+	return n, nil
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, vv := range h {
+		h2[k] = append([]string(nil), vv...)
+	}
+	return h2
+}
@@ -0,0 +1,148 @@
+package gproxy
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FlowStore keeps the latest captured flows in a ring buffer
+type FlowStore struct {
+	// Body 最多保存的字节数, 0 使用默认值
+	MaxBodySize int64
+
+	lastID uint64
+	mu     sync.RWMutex
+	flows  []*Flow
+	next   int
+	index  map[uint64]*Flow
+}
+
+// FlowQuery filters flows, 零值的字段不参与过滤
+type FlowQuery struct {
+	// 支持 *.example.com 这样的通配
+	Host      string
+	Method    string
+	MinStatus int
+	MaxStatus int
+	Since     time.Time
+	Until     time.Time
+	ReplayOf  uint64
+	// 最多返回最新的 Limit 条
+	Limit int
+}
+
+// NewFlowStore returns a FlowStore keeps at most size flows
+func NewFlowStore(size int) *FlowStore {
+	return &FlowStore{
+		flows: make([]*Flow, size),
+		index: make(map[uint64]*Flow, size),
+	}
+}
+
+func (s *FlowStore) nextID() uint64 {
+	return atomic.AddUint64(&s.lastID, 1)
+}
+
+func (s *FlowStore) maxBodySize() int64 {
+	if s.MaxBodySize > 0 {
+		return s.MaxBodySize
+	}
+	return defaultMaxBodySize
+}
+
+// Add adds a flow, the oldest one is dropped if the store is full
+func (s *FlowStore) Add(f *Flow) {
+	if f.ID == 0 {
+		f.ID = s.nextID()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.flows) == 0 {
+		return
+	}
+	if old := s.flows[s.next]; old != nil {
+		delete(s.index, old.ID)
+	}
+	s.flows[s.next] = f
+	s.index[f.ID] = f
+	s.next = (s.next + 1) % len(s.flows)
+}
+
+// Get returns the flow by id
+func (s *FlowStore) Get(id uint64) *Flow {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index[id]
+}
+
+// Len returns the number of flows
+func (s *FlowStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.index)
+}
+
+// Query returns matched flows, the oldest first
+func (s *FlowStore) Query(q FlowQuery) []*Flow {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var flows []*Flow
+	// 从最新的往前找, 满足 Limit 就停下
+	for i := 1; i <= len(s.flows); i++ {
+		f := s.flows[(s.next-i+len(s.flows))%len(s.flows)]
+		if f == nil {
+			break
+		}
+		if !q.match(f) {
+			continue
+		}
+		flows = append(flows, f)
+		if q.Limit > 0 && len(flows) >= q.Limit {
+			break
+		}
+	}
+	for i, j := 0, len(flows)-1; i < j; i, j = i+1, j-1 {
+		flows[i], flows[j] = flows[j], flows[i]
+	}
+	return flows
+}
+
+func (q *FlowQuery) match(f *Flow) bool {
+	if q.Host != "" && !matchHost(q.Host, f.Host()) {
+		return false
+	}
+	if q.Method != "" && !strings.EqualFold(q.Method, f.Request.Method) {
+		return false
+	}
+	if q.MinStatus > 0 || q.MaxStatus > 0 {
+		if f.Response == nil {
+			return false
+		}
+		code := f.Response.StatusCode
+		if q.MinStatus > 0 && code < q.MinStatus {
+			return false
+		}
+		if q.MaxStatus > 0 && code > q.MaxStatus {
+			return false
+		}
+	}
+	if q.ReplayOf != 0 && q.ReplayOf != f.ReplayOf {
+		return false
+	}
+	if !q.Since.IsZero() && f.Timings.Start.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && f.Timings.Start.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+// matchHost 不区分大小写的通配匹配
+func matchHost(pattern, host string) bool {
+	ok, err := path.Match(strings.ToLower(pattern), strings.ToLower(host))
+	return err == nil && ok
+}
@@ -1,8 +1,17 @@
 module github.com/xiilei/gproxy
 
-go 1.12
+go 1.20
 
 require (
+	github.com/dop251/goja v0.0.0-20260106131823-651366fbe6e3
 	github.com/urfave/cli v1.20.0
+	golang.org/x/net v0.17.0
 	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
 )
+
+require (
+	github.com/dlclark/regexp2 v1.11.4 // indirect
+	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
+	github.com/google/pprof v0.0.0-20230207041349-798e818bf904 // indirect
+	golang.org/x/text v0.13.0 // indirect
+)
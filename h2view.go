@@ -0,0 +1,306 @@
+package gproxy
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	defaultH2ViewSize = 64
+	// 每个连接最多记录的 frame 数量
+	maxH2ConnFrames = 8192
+	// 超过这个长度的 frame 不再解析, frame 的长度最大是 1<<24-1, 不能都缓存
+	maxH2FrameSize = 1 << 20
+)
+
+// H2View keeps http2 frames of recently intercepted connections, grouped by stream
+type H2View struct {
+	// 最多保留的连接数, 0 使用默认值
+	Size int
+
+	mu    sync.Mutex
+	conns []*H2Conn
+}
+
+// H2Conn is an intercepted http2 connection
+type H2Conn struct {
+	Addr  string
+	Start time.Time
+
+	mu      sync.Mutex
+	frames  int
+	streams map[uint32]*H2Stream
+}
+
+// H2Stream is the frames of one stream, stream 0 is the connection control frames
+type H2Stream struct {
+	ID     uint32    `json:"id"`
+	Frames []H2Frame `json:"frames"`
+}
+
+// H2Frame is a http2 frame header, with decoded headers for HEADERS/PUSH_PROMISE
+type H2Frame struct {
+	Time time.Time `json:"time"`
+	// 从 proxy 发给客户端的 frame
+	Outbound bool                `json:"outbound"`
+	Type     http2.FrameType     `json:"type"`
+	Flags    http2.Flags         `json:"flags"`
+	StreamID uint32              `json:"streamId"`
+	Length   int                 `json:"length"`
+	Headers  []hpack.HeaderField `json:"headers,omitempty"`
+	// RST_STREAM/GOAWAY 的错误码
+	ErrCode http2.ErrCode `json:"errCode,omitempty"`
+}
+
+// MarshalJSON 输出 frame 类型和错误码的名字
+func (f H2Frame) MarshalJSON() ([]byte, error) {
+	type frame H2Frame
+	v := struct {
+		frame
+		Type    string `json:"type"`
+		ErrCode string `json:"errCode,omitempty"`
+	}{frame: frame(f), Type: f.Type.String()}
+	if f.Type == http2.FrameRSTStream || f.Type == http2.FrameGoAway {
+		v.ErrCode = f.ErrCode.String()
+	}
+	return json.Marshal(v)
+}
+
+// Conns returns recently intercepted connections, the latest first
+func (v *H2View) Conns() []*H2Conn {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	conns := make([]*H2Conn, len(v.conns))
+	for i, c := range v.conns {
+		conns[len(conns)-1-i] = c
+	}
+	return conns
+}
+
+func (v *H2View) add(addr string) *H2Conn {
+	c := &H2Conn{
+		Addr:    addr,
+		Start:   time.Now(),
+		streams: make(map[uint32]*H2Stream),
+	}
+	size := v.Size
+	if size <= 0 {
+		size = defaultH2ViewSize
+	}
+	v.mu.Lock()
+	v.conns = append(v.conns, c)
+	if n := len(v.conns) - size; n > 0 {
+		v.conns = append(v.conns[:0], v.conns[n:]...)
+	}
+	v.mu.Unlock()
+	return c
+}
+
+// 包装 tls 连接, 旁路解析两个方向的 frame
+func (v *H2View) wrap(addr string, conn *tls.Conn) *h2ViewConn {
+	c := v.add(addr)
+	in := newFrameParser(false, c.record)
+	out := newFrameParser(true, c.record)
+	// SETTINGS_HEADER_TABLE_SIZE 作用于对端的 encoder
+	in.peer, out.peer = out, in
+	// 客户端会先发送 connection preface
+	in.skip = len(http2.ClientPreface)
+	return &h2ViewConn{Conn: conn, in: in, out: out}
+}
+
+// Streams returns a copy of the streams ordered by id
+func (c *H2Conn) Streams() []H2Stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	streams := make([]H2Stream, 0, len(c.streams))
+	for _, s := range c.streams {
+		streams = append(streams, H2Stream{
+			ID:     s.ID,
+			Frames: append([]H2Frame(nil), s.Frames...),
+		})
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].ID < streams[j].ID })
+	return streams
+}
+
+func (c *H2Conn) record(f H2Frame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.frames >= maxH2ConnFrames {
+		return
+	}
+	c.frames++
+	s, ok := c.streams[f.StreamID]
+	if !ok {
+		s = &H2Stream{ID: f.StreamID}
+		c.streams[f.StreamID] = s
+	}
+	s.Frames = append(s.Frames, f)
+}
+
+type h2ViewConn struct {
+	*tls.Conn
+	// SETTINGS 会修改对端 parser 的 decoder, 两个方向不能同时解析
+	mu      sync.Mutex
+	in, out *frameParser
+}
+
+func (c *h2ViewConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		c.in.write(p[:n])
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *h2ViewConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.mu.Lock()
+		c.out.write(p[:n])
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// frameParser 增量解析单个方向的 frame, 只缓存 frame header 和需要解析的 payload
+type frameParser struct {
+	outbound bool
+	record   func(H2Frame)
+	peer     *frameParser
+	dec      *hpack.Decoder
+	// 需要丢弃的字节数 (preface 或者 DATA payload)
+	skip   int
+	buf    []byte
+	block  []byte
+	broken bool
+}
+
+func newFrameParser(outbound bool, record func(H2Frame)) *frameParser {
+	return &frameParser{
+		outbound: outbound,
+		record:   record,
+		dec:      hpack.NewDecoder(4096, nil),
+	}
+}
+
+func (p *frameParser) write(b []byte) {
+	if p.broken {
+		return
+	}
+	for len(b) > 0 {
+		if p.skip > 0 {
+			n := p.skip
+			if n > len(b) {
+				n = len(b)
+			}
+			p.skip -= n
+			b = b[n:]
+			continue
+		}
+		p.buf = append(p.buf, b...)
+		b = nil
+		p.parse()
+		// DATA payload 不进 buf, 剩余的字节需要重新走一遍 skip
+		if p.skip > 0 && len(p.buf) > 0 {
+			b, p.buf = p.buf, nil
+		}
+	}
+}
+
+func (p *frameParser) parse() {
+	for len(p.buf) >= 9 && p.skip == 0 && !p.broken {
+		length := int(p.buf[0])<<16 | int(p.buf[1])<<8 | int(p.buf[2])
+		if length > maxH2FrameSize {
+			p.broken = true
+			return
+		}
+		f := H2Frame{
+			Time:     time.Now(),
+			Outbound: p.outbound,
+			Type:     http2.FrameType(p.buf[3]),
+			Flags:    http2.Flags(p.buf[4]),
+			StreamID: binary.BigEndian.Uint32(p.buf[5:9]) & (1<<31 - 1),
+			Length:   length,
+		}
+		if f.Type == http2.FrameData {
+			p.record(f)
+			p.buf = p.buf[9:]
+			p.skip = length
+			break
+		}
+		if len(p.buf) < 9+length {
+			break
+		}
+		p.frame(&f, p.buf[9:9+length])
+		p.buf = p.buf[9+length:]
+	}
+	if len(p.buf) == 0 {
+		p.buf = nil
+	}
+}
+
+func (p *frameParser) frame(f *H2Frame, payload []byte) {
+	switch f.Type {
+	case http2.FrameHeaders, http2.FramePushPromise:
+		if f.Flags.Has(http2.FlagHeadersPadded) && len(payload) > 0 {
+			pad := int(payload[0])
+			if pad >= len(payload) {
+				p.broken = true
+				return
+			}
+			payload = payload[1 : len(payload)-pad]
+		}
+		if f.Type == http2.FramePushPromise {
+			payload = skipBytes(payload, 4)
+		} else if f.Flags.Has(http2.FlagHeadersPriority) {
+			payload = skipBytes(payload, 5)
+		}
+		p.block = append(p.block[:0], payload...)
+	case http2.FrameContinuation:
+		p.block = append(p.block, payload...)
+	case http2.FrameRSTStream:
+		if len(payload) >= 4 {
+			f.ErrCode = http2.ErrCode(binary.BigEndian.Uint32(payload))
+		}
+	case http2.FrameGoAway:
+		if len(payload) >= 8 {
+			f.ErrCode = http2.ErrCode(binary.BigEndian.Uint32(payload[4:]))
+		}
+	case http2.FrameSettings:
+		for ; len(payload) >= 6; payload = payload[6:] {
+			id := http2.SettingID(binary.BigEndian.Uint16(payload))
+			if id == http2.SettingHeaderTableSize {
+				p.peer.dec.SetAllowedMaxDynamicTableSize(binary.BigEndian.Uint32(payload[2:]))
+			}
+		}
+	}
+	endHeaders := f.Type == http2.FrameHeaders || f.Type == http2.FramePushPromise ||
+		f.Type == http2.FrameContinuation
+	if endHeaders && f.Flags.Has(http2.FlagHeadersEndHeaders) {
+		fields, err := p.dec.DecodeFull(p.block)
+		if err != nil {
+			// hpack 状态已经不对了, 之后的 headers 都解不出来
+			p.broken = true
+		}
+		f.Headers = fields
+		p.block = p.block[:0]
+	}
+	p.record(*f)
+}
+
+func skipBytes(b []byte, n int) []byte {
+	if len(b) < n {
+		return nil
+	}
+	return b[n:]
+}
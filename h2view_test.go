@@ -0,0 +1,211 @@
+package gproxy
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func encodeHeaders(enc *hpack.Encoder, buf *bytes.Buffer, fields ...hpack.HeaderField) []byte {
+	buf.Reset()
+	for _, f := range fields {
+		enc.WriteField(f)
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+// h2Frames 用 http2.Framer 写出每种 frame
+func h2Frames(t *testing.T) []byte {
+	var out, hbuf bytes.Buffer
+	enc := hpack.NewEncoder(&hbuf)
+	fr := http2.NewFramer(&out, nil)
+	get := encodeHeaders(enc, &hbuf,
+		hpack.HeaderField{Name: ":method", Value: "GET"},
+		hpack.HeaderField{Name: ":path", Value: "/"},
+	)
+	push := encodeHeaders(enc, &hbuf, hpack.HeaderField{Name: ":path", Value: "/style.css"})
+	cont := encodeHeaders(enc, &hbuf, hpack.HeaderField{Name: "x-trace", Value: "abc"})
+	steps := []func() error{
+		func() error { return fr.WriteSettings(http2.Setting{ID: http2.SettingMaxFrameSize, Val: 1 << 14}) },
+		func() error {
+			return fr.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      1,
+				BlockFragment: get,
+				EndHeaders:    true,
+				PadLength:     3,
+				Priority:      http2.PriorityParam{StreamDep: 0, Weight: 15},
+			})
+		},
+		func() error { return fr.WriteData(1, false, []byte("hello")) },
+		func() error { return fr.WritePriority(3, http2.PriorityParam{Weight: 1}) },
+		func() error {
+			return fr.WritePushPromise(http2.PushPromiseParam{
+				StreamID:      1,
+				PromiseID:     2,
+				BlockFragment: push,
+				EndHeaders:    true,
+				PadLength:     2,
+			})
+		},
+		func() error { return fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 3, BlockFragment: cont[:1]}) },
+		func() error { return fr.WriteContinuation(3, true, cont[1:]) },
+		func() error { return fr.WriteRSTStream(3, http2.ErrCodeCancel) },
+		func() error { return fr.WritePing(false, [8]byte{1}) },
+		func() error { return fr.WriteWindowUpdate(0, 1024) },
+		func() error { return fr.WriteGoAway(1, http2.ErrCodeEnhanceYourCalm, []byte("slow down")) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return out.Bytes()
+}
+
+type h2Want struct {
+	typ      http2.FrameType
+	streamID uint32
+	headers  []hpack.HeaderField
+	errCode  http2.ErrCode
+}
+
+var h2WantFrames = []h2Want{
+	{typ: http2.FrameSettings},
+	{typ: http2.FrameHeaders, streamID: 1, headers: []hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":path", Value: "/"},
+	}},
+	{typ: http2.FrameData, streamID: 1},
+	{typ: http2.FramePriority, streamID: 3},
+	{typ: http2.FramePushPromise, streamID: 1, headers: []hpack.HeaderField{{Name: ":path", Value: "/style.css"}}},
+	{typ: http2.FrameHeaders, streamID: 3},
+	{typ: http2.FrameContinuation, streamID: 3, headers: []hpack.HeaderField{{Name: "x-trace", Value: "abc"}}},
+	{typ: http2.FrameRSTStream, streamID: 3, errCode: http2.ErrCodeCancel},
+	{typ: http2.FramePing},
+	{typ: http2.FrameWindowUpdate},
+	{typ: http2.FrameGoAway, errCode: http2.ErrCodeEnhanceYourCalm},
+}
+
+func checkH2Frames(t *testing.T, got []H2Frame, want []h2Want) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d frames, want %d: %+v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		f := got[i]
+		if f.Type != w.typ || f.StreamID != w.streamID || f.ErrCode != w.errCode {
+			t.Errorf("#%d got %v stream %d %v, want %v stream %d %v",
+				i, f.Type, f.StreamID, f.ErrCode, w.typ, w.streamID, w.errCode)
+		}
+		if len(f.Headers) != 0 || len(w.headers) != 0 {
+			if !reflect.DeepEqual(f.Headers, w.headers) {
+				t.Errorf("#%d %v headers %v, want %v", i, f.Type, f.Headers, w.headers)
+			}
+		}
+	}
+}
+
+func TestFrameParser(t *testing.T) {
+	data := h2Frames(t)
+	// 一次写入, 以及 frame 被切成 1 个和 7 个字节写入的情况
+	for _, step := range []int{len(data), 1, 7} {
+		var got []H2Frame
+		p := newFrameParser(false, func(f H2Frame) { got = append(got, f) })
+		for b := data; len(b) > 0; {
+			n := step
+			if n > len(b) {
+				n = len(b)
+			}
+			p.write(b[:n])
+			b = b[n:]
+		}
+		checkH2Frames(t, got, h2WantFrames)
+		if got[2].Length != len("hello") {
+			t.Errorf("step %d: DATA length %d", step, got[2].Length)
+		}
+	}
+}
+
+func TestFrameParserTruncated(t *testing.T) {
+	data := h2Frames(t)
+	var got []H2Frame
+	p := newFrameParser(false, func(f H2Frame) { got = append(got, f) })
+	// 只有 SETTINGS 和不完整的 HEADERS
+	settings := 9 + 6
+	p.write(data[:settings+12])
+	checkH2Frames(t, got, h2WantFrames[:1])
+	// 剩下的数据到了之后继续解析
+	p.write(data[settings+12:])
+	checkH2Frames(t, got, h2WantFrames)
+}
+
+func TestFrameParserPreface(t *testing.T) {
+	var got []H2Frame
+	p := newFrameParser(false, func(f H2Frame) { got = append(got, f) })
+	p.skip = len(http2.ClientPreface)
+	p.write(append([]byte(http2.ClientPreface), h2Frames(t)...))
+	checkH2Frames(t, got, h2WantFrames)
+}
+
+func TestFrameParserTooLarge(t *testing.T) {
+	var got []H2Frame
+	p := newFrameParser(false, func(f H2Frame) { got = append(got, f) })
+	p.write([]byte{0x10, 0, 1, byte(http2.FrameHeaders), 0, 0, 0, 0, 1})
+	p.write(h2Frames(t))
+	if !p.broken || len(got) != 0 {
+		t.Fatalf("broken %v, %d frames", p.broken, len(got))
+	}
+}
+
+// SETTINGS_HEADER_TABLE_SIZE 修改的是对端的 decoder, 超过默认 4096 的 table size 也能解析
+func TestFrameParserHeaderTableSize(t *testing.T) {
+	var in, out bytes.Buffer
+	fr := http2.NewFramer(&out, nil)
+	fr.WriteSettings(http2.Setting{ID: http2.SettingHeaderTableSize, Val: 8192})
+	var hbuf bytes.Buffer
+	enc := hpack.NewEncoder(&hbuf)
+	enc.SetMaxDynamicTableSizeLimit(8192)
+	enc.SetMaxDynamicTableSize(8192)
+	block := encodeHeaders(enc, &hbuf, hpack.HeaderField{Name: ":status", Value: "200"})
+	http2.NewFramer(&in, nil).WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block, EndHeaders: true})
+
+	var got []H2Frame
+	record := func(f H2Frame) { got = append(got, f) }
+	client := newFrameParser(false, record)
+	server := newFrameParser(true, record)
+	client.peer, server.peer = server, client
+	client.write(out.Bytes())
+	server.write(in.Bytes())
+	if server.broken || len(got) != 2 || len(got[1].Headers) != 1 {
+		t.Fatalf("broken %v, frames %+v", server.broken, got)
+	}
+}
+
+func TestH2ViewLimits(t *testing.T) {
+	v := &H2View{Size: 2}
+	for _, addr := range []string{"a:443", "b:443", "c:443"} {
+		v.add(addr)
+	}
+	conns := v.Conns()
+	if len(conns) != 2 || conns[0].Addr != "c:443" || conns[1].Addr != "b:443" {
+		t.Fatalf("conns %v %v", len(conns), conns)
+	}
+
+	c := conns[0]
+	for i := 0; i < maxH2ConnFrames+10; i++ {
+		c.record(H2Frame{Type: http2.FramePing, StreamID: uint32(i % 3)})
+	}
+	var n int
+	for _, s := range c.Streams() {
+		n += len(s.Frames)
+	}
+	if n != maxH2ConnFrames {
+		t.Fatalf("recorded %d frames, want %d", n, maxH2ConnFrames)
+	}
+	if streams := c.Streams(); streams[0].ID != 0 || streams[2].ID != 2 {
+		t.Fatalf("streams not ordered by id")
+	}
+}
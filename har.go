@@ -0,0 +1,506 @@
+package gproxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 http://www.softwareishard.com/blog/har-12-spec/
+// 自定义的字段以 _ 开头
+type har struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Connection      string      `json:"connection,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+	TLS             *harTLS     `json:"_tls,omitempty"`
+	ClientTLS       *harTLS     `json:"_clientTLS,omitempty"`
+	ClientAddr      string      `json:"_clientAddr,omitempty"`
+	ID              uint64      `json:"_id,omitempty"`
+	Error           string      `json:"_error,omitempty"`
+	// 和 chrome 导出的格式一样
+	WebSocketMessages []harWebSocketMessage `json:"_webSocketMessages,omitempty"`
+}
+
+type harWebSocketMessage struct {
+	Type string `json:"type"`
+	// unix 时间, 秒
+	Time   float64 `json:"time"`
+	Opcode int     `json:"opcode"`
+	Data   string  `json:"data"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path,omitempty"`
+	Domain   string     `json:"domain,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	HTTPOnly bool       `json:"httpOnly,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	// postData 没有定义 encoding
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+type harContent struct {
+	Size        int64  `json:"size"`
+	Compression int64  `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+}
+
+// 单位是毫秒, 没有的阶段为 -1
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+type harTLS struct {
+	Protocol     string `json:"protocol"`
+	Cipher       string `json:"cipher"`
+	ServerName   string `json:"serverName,omitempty"`
+	NextProtocol string `json:"alpn,omitempty"`
+}
+
+// ExportHAR writes flows as HAR 1.2
+func ExportHAR(w io.Writer, flows []*Flow) error {
+	h := har{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "gproxy", Version: Version},
+		Entries: make([]harEntry, 0, len(flows)),
+	}}
+	for _, f := range flows {
+		h.Log.Entries = append(h.Log.Entries, newHAREntry(f))
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&h)
+}
+
+// ImportHAR reads flows from HAR, 压缩过的 body 会以解压后的形式保存
+func ImportHAR(r io.Reader) ([]*Flow, error) {
+	var h har
+	if err := json.NewDecoder(r).Decode(&h); err != nil {
+		return nil, err
+	}
+	flows := make([]*Flow, 0, len(h.Log.Entries))
+	for i := range h.Log.Entries {
+		f, err := h.Log.Entries[i].flow()
+		if err != nil {
+			return nil, err
+		}
+		flows = append(flows, f)
+	}
+	return flows, nil
+}
+
+func newHAREntry(f *Flow) harEntry {
+	t := f.Timings
+	e := harEntry{
+		StartedDateTime: t.Start,
+		Time:            millis(t.End.Sub(t.Start)),
+		Request:         newHARRequest(f.Request),
+		Timings: harTimings{
+			DNS:     millis(t.DNS),
+			Connect: millis(t.Connect),
+			SSL:     millis(t.TLS),
+			Send:    millis(t.Send),
+			Wait:    millis(t.Wait),
+			Receive: millis(t.Receive),
+		},
+		TLS:        newHARTLS(f.Conn.ServerTLS),
+		ClientTLS:  newHARTLS(f.Conn.ClientTLS),
+		ClientAddr: f.Conn.ClientAddr,
+		ID:         f.ID,
+		Error:      f.Error,
+	}
+	// HAR 的 connect 包含了 ssl
+	if t.TLS > 0 && t.Connect >= 0 {
+		e.Timings.Connect = millis(t.Connect + t.TLS)
+	}
+	e.Timings.Blocked = e.Time
+	for _, d := range []float64{e.Timings.DNS, e.Timings.Connect, e.Timings.Send,
+		e.Timings.Wait, e.Timings.Receive} {
+		if d > 0 {
+			e.Timings.Blocked -= d
+		}
+	}
+	if e.Timings.Blocked < 0 {
+		e.Timings.Blocked = 0
+	}
+	if host, port, err := net.SplitHostPort(f.Conn.ServerAddr); err == nil {
+		e.ServerIPAddress, e.Connection = host, port
+	}
+	if f.WebSocket != nil {
+		for _, m := range f.WebSocket.Frames() {
+			data := string(m.Payload)
+			if m.Opcode != wsText {
+				data = base64.StdEncoding.EncodeToString(m.Payload)
+			}
+			e.WebSocketMessages = append(e.WebSocketMessages, harWebSocketMessage{
+				Type:   m.Direction,
+				Time:   float64(m.Time.UnixNano()) / 1e9,
+				Opcode: m.Opcode,
+				Data:   data,
+			})
+		}
+	}
+	if f.Response != nil {
+		e.Response = newHARResponse(f.Response)
+	} else {
+		// 没有响应的请求 status 为 0
+		e.Response = harResponse{
+			Cookies:     []harCookie{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		}
+	}
+	return e
+}
+
+func newHARRequest(r *FlowRequest) harRequest {
+	req := harRequest{
+		Method:      r.Method,
+		URL:         r.URL,
+		HTTPVersion: r.Proto,
+		Headers:     harHeaders(r.Header),
+		Cookies:     []harCookie{},
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    r.BodySize,
+	}
+	hr := http.Request{Header: r.Header}
+	for _, c := range hr.Cookies() {
+		req.Cookies = append(req.Cookies, harCookie{Name: c.Name, Value: c.Value})
+	}
+	if u, err := url.Parse(r.URL); err == nil {
+		for k, vv := range u.Query() {
+			for _, v := range vv {
+				req.QueryString = append(req.QueryString, harNameValue{Name: k, Value: v})
+			}
+		}
+	}
+	if r.BodySize > 0 {
+		req.PostData = &harPostData{MimeType: r.Header.Get("Content-Type")}
+		req.PostData.Text, req.PostData.Encoding = harText(r.Body)
+	}
+	return req
+}
+
+func newHARResponse(r *FlowResponse) harResponse {
+	res := harResponse{
+		Status:      r.StatusCode,
+		StatusText:  http.StatusText(r.StatusCode),
+		HTTPVersion: r.Proto,
+		Headers:     harHeaders(r.Header),
+		Cookies:     []harCookie{},
+		RedirectURL: r.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    r.BodySize,
+		Content: harContent{
+			Size:     r.BodySize,
+			MimeType: r.Header.Get("Content-Type"),
+		},
+	}
+	hr := http.Response{Header: r.Header}
+	for _, c := range hr.Cookies() {
+		hc := harCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			expires := c.Expires
+			hc.Expires = &expires
+		}
+		res.Cookies = append(res.Cookies, hc)
+	}
+	// content.text 是解压后的内容
+	body := r.Body
+	if int64(len(body)) == r.BodySize {
+		if decoded, err := decodeBody(r.Header.Get("Content-Encoding"), body); err == nil {
+			res.Content.Size = int64(len(decoded))
+			if saved := res.Content.Size - r.BodySize; saved > 0 {
+				res.Content.Compression = saved
+			}
+			body = decoded
+		}
+	}
+	res.Content.Text, res.Content.Encoding = harText(body)
+	return res
+}
+
+func (e *harEntry) flow() (*Flow, error) {
+	f := &Flow{
+		ID: e.ID,
+		Request: &FlowRequest{
+			Method: e.Request.Method,
+			URL:    e.Request.URL,
+			Proto:  e.Request.HTTPVersion,
+			Header: httpHeader(e.Request.Headers),
+		},
+		Conn: ConnInfo{
+			ClientAddr: e.ClientAddr,
+			ClientTLS:  e.ClientTLS.info(),
+			ServerTLS:  e.TLS.info(),
+		},
+		Timings: Timings{
+			Start:   e.StartedDateTime,
+			End:     e.StartedDateTime.Add(duration(e.Time)),
+			DNS:     duration(e.Timings.DNS),
+			Connect: duration(e.Timings.Connect),
+			TLS:     duration(e.Timings.SSL),
+			Send:    duration(e.Timings.Send),
+			Wait:    duration(e.Timings.Wait),
+			Receive: duration(e.Timings.Receive),
+		},
+		Error: e.Error,
+	}
+	if f.Timings.TLS > 0 && f.Timings.Connect >= f.Timings.TLS {
+		f.Timings.Connect -= f.Timings.TLS
+	}
+	if e.ServerIPAddress != "" {
+		f.Conn.ServerAddr = e.ServerIPAddress
+		if e.Connection != "" {
+			f.Conn.ServerAddr = net.JoinHostPort(e.ServerIPAddress, e.Connection)
+		}
+	}
+	if len(e.WebSocketMessages) > 0 {
+		f.WebSocket = new(WebSocket)
+		for _, m := range e.WebSocketMessages {
+			payload := []byte(m.Data)
+			if m.Opcode != wsText {
+				payload, _ = base64.StdEncoding.DecodeString(m.Data)
+			}
+			f.WebSocket.add(&WebSocketFrame{
+				Time:      time.Unix(0, int64(m.Time*1e9)),
+				Direction: m.Type,
+				Opcode:    m.Opcode,
+				Fin:       true,
+				Length:    int64(len(payload)),
+				Payload:   payload,
+			})
+		}
+	}
+	if p := e.Request.PostData; p != nil {
+		body, err := harBody(p.Text, p.Encoding)
+		if err != nil {
+			return nil, err
+		}
+		f.Request.Body = body
+		f.Request.BodySize = int64(len(body))
+	}
+	if e.Response.Status == 0 {
+		return f, nil
+	}
+	body, err := harBody(e.Response.Content.Text, e.Response.Content.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	f.Response = &FlowResponse{
+		StatusCode: e.Response.Status,
+		Proto:      e.Response.HTTPVersion,
+		Header:     httpHeader(e.Response.Headers),
+		Body:       body,
+		BodySize:   int64(len(body)),
+	}
+	// HAR 里的是解压后的内容, headers 要和 body 保持一致
+	if f.Response.Header.Get("Content-Encoding") != "" {
+		f.Response.Header.Del("Content-Encoding")
+		f.Response.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return f, nil
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	nv := make([]harNameValue, 0, len(h))
+	for k, vv := range h {
+		for _, v := range vv {
+			nv = append(nv, harNameValue{Name: k, Value: v})
+		}
+	}
+	return nv
+}
+
+func httpHeader(nv []harNameValue) http.Header {
+	h := make(http.Header, len(nv))
+	for _, v := range nv {
+		// h2 的伪头部不是 header
+		if strings.HasPrefix(v.Name, ":") {
+			continue
+		}
+		h.Add(v.Name, v.Value)
+	}
+	return h
+}
+
+// 不是 utf8 的内容用 base64
+func harText(b []byte) (text, encoding string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return base64.StdEncoding.EncodeToString(b), "base64"
+}
+
+func harBody(text, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(text)
+	}
+	return []byte(text), nil
+}
+
+func decodeBody(encoding string, body []byte) ([]byte, error) {
+	var r io.Reader
+	switch strings.ToLower(encoding) {
+	case "":
+		return body, nil
+	case "gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		r = gr
+	case "deflate":
+		r = flate.NewReader(bytes.NewReader(body))
+	default:
+		return nil, &badStringError{"unsupported content encoding", encoding}
+	}
+	return ioutil.ReadAll(r)
+}
+
+func newHARTLS(info *TLSInfo) *harTLS {
+	if info == nil {
+		return nil
+	}
+	return &harTLS{
+		Protocol:     tlsVersionName(info.Version),
+		Cipher:       tls.CipherSuiteName(info.CipherSuite),
+		ServerName:   info.ServerName,
+		NextProtocol: info.NegotiatedProtocol,
+	}
+}
+
+func (t *harTLS) info() *TLSInfo {
+	if t == nil {
+		return nil
+	}
+	info := &TLSInfo{
+		ServerName:         t.ServerName,
+		NegotiatedProtocol: t.NextProtocol,
+	}
+	for v, name := range tlsVersions {
+		if name == t.Protocol {
+			info.Version = v
+		}
+	}
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if cs.Name == t.Cipher {
+			info.CipherSuite = cs.ID
+		}
+	}
+	return info
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+func tlsVersionName(v uint16) string {
+	if name, ok := tlsVersions[v]; ok {
+		return name
+	}
+	return "0x" + strconv.FormatUint(uint64(v), 16)
+}
+
+func millis(d time.Duration) float64 {
+	if d < 0 {
+		return -1
+	}
+	return float64(d) / float64(time.Millisecond)
+}
+
+func duration(ms float64) time.Duration {
+	if ms < 0 {
+		return -1
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
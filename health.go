@@ -0,0 +1,361 @@
+package gproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthCheck configures active probes and passive ejection of a pool
+//
+//	{"type": "http", "path": "/healthz", "interval": "5s", "timeout": "2s",
+//	 "unhealthy": 3, "healthy": 2, "maxFails": 5, "failTimeout": "30s", "slowStart": "20s"}
+type HealthCheck struct {
+	// http 或者 tcp, 空不做主动检查
+	Type string `json:"type,omitempty"`
+	// http 检查的路径, 2xx 和 3xx 算成功
+	Path     string   `json:"path,omitempty"`
+	Interval Duration `json:"interval,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty"`
+	// 连续失败 Unhealthy 次标记为不健康, 连续成功 Healthy 次恢复
+	Unhealthy int `json:"unhealthy,omitempty"`
+	Healthy   int `json:"healthy,omitempty"`
+	// 被动检查: 请求连续失败 MaxFails 次(连接错误, 超时, 502/503/504)摘除 FailTimeout, 0 不做被动检查
+	MaxFails    int      `json:"maxFails,omitempty"`
+	FailTimeout Duration `json:"failTimeout,omitempty"`
+	// 恢复之后权重在 SlowStart 内从 1 线性增加到配置的权重
+	SlowStart Duration `json:"slowStart,omitempty"`
+}
+
+func (hc *HealthCheck) init() error {
+	if hc == nil {
+		return nil
+	}
+	switch hc.Type {
+	case "", "tcp":
+	case "http":
+		if hc.Path == "" {
+			hc.Path = "/"
+		}
+		if !strings.HasPrefix(hc.Path, "/") {
+			return fmt.Errorf("health path %q must start with /", hc.Path)
+		}
+	default:
+		return fmt.Errorf("unknown health check type %q", hc.Type)
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = Duration(5 * time.Second)
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = Duration(2 * time.Second)
+	}
+	if hc.Unhealthy <= 0 {
+		hc.Unhealthy = 3
+	}
+	if hc.Healthy <= 0 {
+		hc.Healthy = 2
+	}
+	if hc.FailTimeout <= 0 {
+		hc.FailTimeout = Duration(30 * time.Second)
+	}
+	return nil
+}
+
+// member 是 pool 里的一个 backend 和它的健康状态, 由 Pool.mu 保护
+type member struct {
+	url    *url.URL
+	weight int
+	node   *node
+
+	// 主动检查的结果
+	healthy bool
+	oks     int
+	fails   int
+	checked time.Time
+	// 被动检查连续失败的次数和摘除到什么时候
+	passive int
+	ejected time.Time
+	// 最近一次恢复的时间, 用于 slow start
+	recovered time.Time
+	lastErr   string
+}
+
+func (m *member) available(now time.Time) bool {
+	return m.healthy && !now.Before(m.ejected)
+}
+
+// effectiveWeight 恢复之后的一段时间内逐渐增加权重
+func (m *member) effectiveWeight(hc *HealthCheck, now time.Time) int {
+	if hc == nil || hc.SlowStart <= 0 || m.recovered.IsZero() {
+		return m.weight
+	}
+	d := now.Sub(m.recovered)
+	if d >= time.Duration(hc.SlowStart) {
+		return m.weight
+	}
+	w := int(int64(m.weight) * int64(d) / int64(hc.SlowStart))
+	if w < 1 {
+		w = 1
+	}
+	return w
+}
+
+// recover 由不可用变成可用
+func (m *member) recover(now time.Time) {
+	m.recovered = now
+	// 清掉累积的 cw, 避免恢复之后连续命中
+	m.node.cw = 0
+}
+
+// pick 在可用的 backend 里选择一个, 都不可用时返回 nil
+func (p *Pool) pick(req *http.Request) *member {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	nodes := make([]*node, 0, len(p.members))
+	for _, m := range p.members {
+		if !m.available(now) {
+			continue
+		}
+		m.node.ew = m.effectiveWeight(p.Health, now)
+		nodes = append(nodes, m.node)
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	n := p.balancer.pick(nodes, req)
+	n.conns++
+	return p.members[n.id]
+}
+
+// release 请求结束
+func (p *Pool) release(m *member) {
+	p.mu.Lock()
+	m.node.conns--
+	p.mu.Unlock()
+}
+
+// observe 记录收到响应头或者出错的时间
+func (p *Pool) observe(m *member, d time.Duration) {
+	p.mu.Lock()
+	m.node.observe(d)
+	p.mu.Unlock()
+}
+
+// fail 记录一次请求失败
+func (p *Pool) fail(m *member, err error) {
+	hc := p.Health
+	if hc == nil || hc.MaxFails <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m.passive++
+	m.lastErr = err.Error()
+	if m.passive < hc.MaxFails {
+		return
+	}
+	now := time.Now()
+	if now.Before(m.ejected) {
+		return
+	}
+	m.passive = 0
+	m.ejected = now.Add(time.Duration(hc.FailTimeout))
+	m.recovered = m.ejected
+	m.node.cw = 0
+	logger.Printf("health pool %s eject %s for %s: %s", p.Name, m.url, time.Duration(hc.FailTimeout), err)
+}
+
+// success 记录一次请求成功
+func (p *Pool) success(m *member) {
+	if p.Health == nil || p.Health.MaxFails <= 0 {
+		return
+	}
+	p.mu.Lock()
+	m.passive = 0
+	p.mu.Unlock()
+}
+
+// check 定时主动检查所有 backend, 直到 done 关闭
+func (p *Pool) check(rt http.RoundTripper, done <-chan struct{}) {
+	t := time.NewTicker(time.Duration(p.Health.Interval))
+	defer t.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, m := range p.members {
+			wg.Add(1)
+			go func(m *member) {
+				defer wg.Done()
+				p.probed(m, p.probe(rt, m))
+			}(m)
+		}
+		wg.Wait()
+		select {
+		case <-t.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (p *Pool) probe(rt http.RoundTripper, m *member) error {
+	hc := p.Health
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(hc.Timeout))
+	defer cancel()
+	if hc.Type == "tcp" {
+		conn, err := dialer.DialContext(ctx, "tcp", hostPort(m.url))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	u := *m.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + hc.Path
+	u.RawPath = ""
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 400 {
+		return fmt.Errorf("status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (p *Pool) probed(m *member, err error) {
+	hc := p.Health
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	m.checked = now
+	if err != nil {
+		m.lastErr = err.Error()
+		m.oks = 0
+		m.fails++
+		if m.healthy && m.fails >= hc.Unhealthy {
+			m.healthy = false
+			logger.Printf("health pool %s %s unhealthy: %s", p.Name, m.url, err)
+		}
+		return
+	}
+	m.fails = 0
+	m.oks++
+	if !m.healthy && m.oks >= hc.Healthy {
+		m.healthy = true
+		m.lastErr = ""
+		m.recover(now)
+		logger.Printf("health pool %s %s healthy", p.Name, m.url)
+	}
+}
+
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), urlPort(u))
+}
+
+// 502/503/504 说明 backend 不可用, 其它状态码是正常的响应
+func reverseResponse(res *http.Response) error {
+	t, ok := res.Request.Context().Value(reverseKey{}).(*reverseTarget)
+	if !ok {
+		return nil
+	}
+	t.pool.observe(t.member, time.Since(t.start))
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		t.pool.fail(t.member, fmt.Errorf("status %d", res.StatusCode))
+	default:
+		t.pool.success(t.member)
+	}
+	return nil
+}
+
+func reverseError(rw http.ResponseWriter, req *http.Request, err error) {
+	// 客户端取消的请求不算 backend 失败
+	if t, ok := req.Context().Value(reverseKey{}).(*reverseTarget); ok && !errors.Is(err, context.Canceled) {
+		t.pool.observe(t.member, time.Since(t.start))
+		t.pool.fail(t.member, err)
+	}
+	proxyError(rw, req, err)
+}
+
+// BackendStatus is the health state of a backend
+type BackendStatus struct {
+	URL             string     `json:"url"`
+	Weight          int        `json:"weight"`
+	EffectiveWeight int        `json:"effectiveWeight"`
+	Healthy         bool       `json:"healthy"`
+	Ejected         *time.Time `json:"ejected,omitempty"`
+	Fails           int        `json:"fails"`
+	Conns           int        `json:"conns"`
+	Latency         Duration   `json:"latency,omitempty"`
+	Checked         *time.Time `json:"checked,omitempty"`
+	Error           string     `json:"error,omitempty"`
+}
+
+// PoolStatus is the health state of a pool
+type PoolStatus struct {
+	Name     string           `json:"name"`
+	Backends []*BackendStatus `json:"backends"`
+}
+
+// Status returns the health state of the pool
+func (p *Pool) Status() *PoolStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	s := &PoolStatus{Name: p.Name}
+	for _, m := range p.members {
+		bs := &BackendStatus{
+			URL:     m.url.String(),
+			Weight:  m.weight,
+			Healthy: m.available(now),
+			Fails:   m.fails + m.passive,
+			Conns:   m.node.conns,
+			Latency: Duration(m.node.ewma),
+			Error:   m.lastErr,
+		}
+		if !m.checked.IsZero() {
+			checked := m.checked
+			bs.Checked = &checked
+		}
+		if bs.Healthy {
+			bs.EffectiveWeight = m.effectiveWeight(p.Health, now)
+		}
+		if now.Before(m.ejected) {
+			ejected := m.ejected
+			bs.Ejected = &ejected
+		}
+		s.Backends = append(s.Backends, bs)
+	}
+	return s
+}
+
+// StatusHandler serves the health state of all pools as json
+func (h *ReverseHandler) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			apiError(rw, http.StatusMethodNotAllowed, errMethod)
+			return
+		}
+		pools := make([]*PoolStatus, 0, len(h.Pools))
+		for _, p := range h.Pools {
+			pools = append(pools, p.Status())
+		}
+		sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+		writeJSON(rw, pools)
+	})
+}
@@ -0,0 +1,226 @@
+package gproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// 共享的 limiter 不能修改 burst, 一次最多等待这么多字节
+const limitBurst = 32 * 1024
+
+// LimitRule limits the bandwidth of all connections to matched hosts or from matched clients,
+// 匹配的连接共享同一个 token bucket
+type LimitRule struct {
+	// 用于运行时修改
+	Name string `json:"name"`
+	// 上游 host, 支持 *.example.com 这样的通配
+	Host string `json:"host,omitempty"`
+	// 客户端 ip 或者 10.0.0.0/8
+	Client string `json:"client,omitempty"`
+	// 下行(发给客户端)和上行(客户端发来)的带宽, bytes/s, 0 不限制
+	Down uint `json:"down"`
+	Up   uint `json:"up"`
+
+	mu     sync.Mutex
+	client *net.IPNet
+	down   *rate.Limiter
+	up     *rate.Limiter
+}
+
+func (l *LimitRule) compile() error {
+	if l.Client != "" {
+		s := l.Client
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("limit %s: %s", l.Name, err)
+		}
+		l.client = ipnet
+	}
+	l.down = rate.NewLimiter(bpsLimit(l.Down), limitBurst)
+	l.up = rate.NewLimiter(bpsLimit(l.Up), limitBurst)
+	return nil
+}
+
+func bpsLimit(bps uint) rate.Limit {
+	if bps == 0 {
+		return rate.Inf
+	}
+	return rate.Limit(bps)
+}
+
+// SetLimit changes the bandwidth, 已经建立的连接立即生效
+func (l *LimitRule) SetLimit(down, up uint) {
+	l.mu.Lock()
+	l.Down, l.Up = down, up
+	l.mu.Unlock()
+	l.down.SetLimit(bpsLimit(down))
+	l.up.SetLimit(bpsLimit(up))
+}
+
+// Limit returns the current bandwidth
+func (l *LimitRule) Limit() (down, up uint) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Down, l.Up
+}
+
+func (l *LimitRule) match(host, client string) bool {
+	if l.Host != "" && !matchHost(l.Host, host) {
+		return false
+	}
+	if l.client != nil {
+		ip := net.ParseIP(client)
+		if ip == nil || !l.client.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchLimits 返回 host 和 client 匹配的所有规则, 需要同时满足
+func matchLimits(rules []*LimitRule, host, client string) (down, up limiters) {
+	for _, l := range rules {
+		if l.match(host, client) {
+			down = append(down, l.down)
+			up = append(up, l.up)
+		}
+	}
+	return
+}
+
+// FindLimit returns the limit rule by name
+func (r *Rules) FindLimit(name string) *LimitRule {
+	for _, l := range r.Limits {
+		if l.Name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// clientIP 去掉 RemoteAddr 的端口
+func clientIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+type limiters []*rate.Limiter
+
+func (ls limiters) waitN(ctx context.Context, n int) error {
+	for _, l := range ls {
+		if err := l.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limitedConn 多个连接共享 limiter, Read 是上行, Write 是下行
+type limitedConn struct {
+	net.Conn
+	io limitedIO
+}
+
+func newLimitedConn(c net.Conn, down, up limiters) net.Conn {
+	if len(down) == 0 && len(up) == 0 {
+		return c
+	}
+	return &limitedConn{
+		Conn: c,
+		io:   limitedIO{inner: c, read: up, write: down},
+	}
+}
+
+func (c *limitedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	return c.io.Read(p)
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	return c.io.Write(p)
+}
+
+type limitedIO struct {
+	inner       io.ReadWriter
+	read, write limiters
+}
+
+func (l limitedIO) Read(p []byte) (int, error) {
+	if len(l.read) == 0 {
+		return l.inner.Read(p)
+	}
+	if len(p) > limitBurst {
+		p = p[:limitBurst]
+	}
+	n, err := l.inner.Read(p)
+	if n > 0 {
+		if err := l.read.waitN(context.TODO(), n); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+func (l limitedIO) Write(p []byte) (int, error) {
+	if len(l.write) == 0 {
+		return l.inner.Write(p)
+	}
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > limitBurst {
+			chunk = chunk[:limitBurst]
+		}
+		if err := l.write.waitN(context.TODO(), len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := l.inner.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// limitRequest 用于普通 http 请求
+func limitRequest(rules []*LimitRule, rw http.ResponseWriter, req *http.Request) (http.ResponseWriter, *http.Request) {
+	down, up := matchLimits(rules, req.URL.Hostname(), clientIP(req.RemoteAddr))
+	if len(up) > 0 && req.Body != nil && req.Body != http.NoBody {
+		req.Body = &shapedBody{
+			ReadCloser: req.Body,
+			r:          limitedIO{inner: readOnly{req.Body}, read: up},
+		}
+	}
+	if len(down) == 0 {
+		return rw, req
+	}
+	return &shapedWriter{
+		ResponseWriter: rw,
+		w:              limitedIO{inner: writeOnly{rw}, write: down},
+		wrap: func(c net.Conn) net.Conn {
+			return newLimitedConn(c, down, up)
+		},
+	}, req
+}
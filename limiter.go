@@ -14,6 +14,8 @@ type RateReader struct {
 	inner   io.ReadWriter
 	context context.Context
 	limiter *rate.Limiter
+	// nil 时不限制 Write
+	writeLimiter *rate.Limiter
 }
 
 // NewRateReader return a new RateReader
@@ -29,7 +31,36 @@ func NewRateReader(reader io.ReadWriter, bps uint) *RateReader {
 	return r
 }
 
+// NewRateReadWriter return a RateReader limits both Read and Write, 0 不限制
+func NewRateReadWriter(rw io.ReadWriter, readBps, writeBps uint) *RateReader {
+	return &RateReader{
+		inner:        rw,
+		limiter:      newLimiter(readBps),
+		writeLimiter: newLimiter(writeBps),
+		context:      context.TODO(),
+	}
+}
+
+// newLimiter 的 burst 最多是一秒的流量, 这样开始时不会一下子发出太多数据
+func newLimiter(bps uint) *rate.Limiter {
+	if bps == 0 {
+		return nil
+	}
+	b := int(bps)
+	if b > burst {
+		b = burst
+	}
+	return rate.NewLimiter(rate.Limit(bps), b)
+}
+
 func (r *RateReader) Read(p []byte) (int, error) {
+	if r.limiter == nil {
+		return r.inner.Read(p)
+	}
+	// 一次读取的数据不能超过 burst, 否则 WaitN 直接返回错误
+	if b := r.limiter.Burst(); len(p) > b {
+		p = p[:b]
+	}
 	n, err := r.inner.Read(p)
 	if err != nil {
 		return n, err
@@ -40,7 +71,25 @@ func (r *RateReader) Read(p []byte) (int, error) {
 	return n, nil
 }
 
-// 不限制 Write
 func (r *RateReader) Write(p []byte) (int, error) {
-	return r.inner.Write(p)
+	if r.writeLimiter == nil {
+		return r.inner.Write(p)
+	}
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if b := r.writeLimiter.Burst(); len(chunk) > b {
+			chunk = chunk[:b]
+		}
+		if err := r.writeLimiter.WaitN(r.context, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := r.inner.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
 }
@@ -1,9 +1,24 @@
 package gproxy
 
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
 type node struct {
 	cw int
 	ew int
 	id int
+
+	// 正在处理的请求数
+	conns int
+	// 响应时间的 EWMA, 纳秒
+	ewma float64
 }
 
 // swrr
@@ -21,3 +36,256 @@ func swrr(s []*node) *node {
 	best.cw -= tw
 	return best
 }
+
+// balancer 从可用的 node 里选择一个, 调用时持有 Pool.mu
+type balancer interface {
+	pick(s []*node, req *http.Request) *node
+}
+
+// newBalancer 返回 name 对应的算法, names 是所有 backend 的标识, 下标是 node.id
+//
+//	swrr      平滑加权轮询, 默认
+//	leastconn 当前请求数/权重最小, 相同时加权轮询
+//	ring      一致性哈希环, 按 key 粘滞
+//	maglev    maglev 一致性哈希, 按 key 粘滞
+//	p2c       随机选两个, 取 EWMA 响应时间*(请求数+1) 较小的
+func newBalancer(name, key string, names []string, weights []int) (balancer, error) {
+	switch name {
+	case "", "swrr":
+		return swrrBalancer{}, nil
+	case "leastconn":
+		return leastConn{}, nil
+	case "p2c":
+		return p2c{}, nil
+	case "ring", "maglev":
+		kf, err := parseHashKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if name == "ring" {
+			return newRing(kf, names, weights), nil
+		}
+		return &maglev{key: kf, names: names, weights: weights}, nil
+	}
+	return nil, fmt.Errorf("unknown balancer %q", name)
+}
+
+type swrrBalancer struct{}
+
+func (swrrBalancer) pick(s []*node, req *http.Request) *node {
+	return swrr(s)
+}
+
+type leastConn struct{}
+
+func (leastConn) pick(s []*node, req *http.Request) *node {
+	var least []*node
+	for _, n := range s {
+		if len(least) == 0 {
+			least = append(least, n)
+			continue
+		}
+		// conns/ew 比较, 避免除法
+		a, b := n.conns*least[0].ew, least[0].conns*n.ew
+		if a < b {
+			least = append(least[:0], n)
+		} else if a == b {
+			least = append(least, n)
+		}
+	}
+	return swrr(least)
+}
+
+// EWMA 的权重, 越大越看重最近的响应时间
+const ewmaAlpha = 0.3
+
+// observe 记录一次响应时间
+func (n *node) observe(d time.Duration) {
+	if n.ewma == 0 {
+		n.ewma = float64(d)
+		return
+	}
+	n.ewma = ewmaAlpha*float64(d) + (1-ewmaAlpha)*n.ewma
+}
+
+type p2c struct{}
+
+func (p2c) pick(s []*node, req *http.Request) *node {
+	if len(s) == 1 {
+		return s[0]
+	}
+	i := rand.Intn(len(s))
+	j := rand.Intn(len(s) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := s[i], s[j]
+	// 还没有响应时间的 node 优先, 让它有机会被测量
+	if a.cost() <= b.cost() {
+		return a
+	}
+	return b
+}
+
+func (n *node) cost() float64 {
+	return n.ewma * float64(n.conns+1)
+}
+
+// hashKey 返回请求的 key, 空的时候退回加权轮询
+type hashKey func(req *http.Request) string
+
+// parseHashKey 支持 ip, header:X-User, cookie:session
+func parseHashKey(key string) (hashKey, error) {
+	switch {
+	case key == "ip":
+		return func(req *http.Request) string {
+			return clientIP(req.RemoteAddr)
+		}, nil
+	case strings.HasPrefix(key, "header:"):
+		name := strings.TrimPrefix(key, "header:")
+		return func(req *http.Request) string {
+			return req.Header.Get(name)
+		}, nil
+	case strings.HasPrefix(key, "cookie:"):
+		name := strings.TrimPrefix(key, "cookie:")
+		return func(req *http.Request) string {
+			c, err := req.Cookie(name)
+			if err != nil {
+				return ""
+			}
+			return c.Value
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid hash key %q, must be ip, header:<name> or cookie:<name>", key)
+}
+
+// hash64 是 fnv-1a, 直接遍历 s 的字节, 不需要分配内存
+func hash64(s string) uint64 {
+	x := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		x ^= uint64(s[i])
+		x *= 1099511628211
+	}
+	// fnv 的低位分布不均匀, 再混合一次
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return x
+}
+
+// 每个单位权重在环上的虚拟节点数
+const ringReplicas = 160
+
+type ringPoint struct {
+	hash uint64
+	id   int
+}
+
+// ring 是一致性哈希环, backend 不可用时顺时针找下一个
+type ring struct {
+	key    hashKey
+	points []ringPoint
+}
+
+func newRing(key hashKey, names []string, weights []int) *ring {
+	r := &ring{key: key}
+	for id, name := range names {
+		for i := 0; i < ringReplicas*weights[id]; i++ {
+			r.points = append(r.points, ringPoint{hash: hash64(name + "#" + strconv.Itoa(i)), id: id})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return r
+}
+
+func (r *ring) pick(s []*node, req *http.Request) *node {
+	k := r.key(req)
+	if k == "" {
+		return swrr(s)
+	}
+	avail := make(map[int]*node, len(s))
+	for _, n := range s {
+		avail[n.id] = n
+	}
+	h := hash64(k)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	for j := 0; j < len(r.points); j++ {
+		if n, ok := avail[r.points[(i+j)%len(r.points)].id]; ok {
+			return n
+		}
+	}
+	return swrr(s)
+}
+
+// maglev 的查找表大小, 需要是质数
+const maglevSize = 65537
+
+// maglev 按可用的 backend 生成查找表, 可用的 backend 变化时重新生成
+type maglev struct {
+	key     hashKey
+	names   []string
+	weights []int
+
+	// 生成 table 时可用的 node.id
+	avail []int
+	table []*node
+}
+
+func (m *maglev) pick(s []*node, req *http.Request) *node {
+	k := m.key(req)
+	if k == "" {
+		return swrr(s)
+	}
+	if m.changed(s) {
+		m.avail = m.avail[:0]
+		for _, n := range s {
+			m.avail = append(m.avail, n.id)
+		}
+		m.table = m.populate(s)
+	}
+	return m.table[hash64(k)%maglevSize]
+}
+
+// changed 判断可用的 backend 和生成 table 时是否不同
+func (m *maglev) changed(s []*node) bool {
+	if m.table == nil || len(s) != len(m.avail) {
+		return true
+	}
+	for i, n := range s {
+		if n.id != m.avail[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// populate 按 maglev 论文的方法填充查找表, 权重大的 backend 每轮多填几次
+func (m *maglev) populate(s []*node) []*node {
+	offsets := make([]uint64, len(s))
+	skips := make([]uint64, len(s))
+	next := make([]uint64, len(s))
+	for i, n := range s {
+		name := m.names[n.id]
+		offsets[i] = hash64(name+"#offset") % maglevSize
+		skips[i] = hash64(name+"#skip")%(maglevSize-1) + 1
+	}
+	table := make([]*node, maglevSize)
+	filled := 0
+	for {
+		for i, n := range s {
+			for w := 0; w < m.weights[n.id]; w++ {
+				c := (offsets[i] + next[i]*skips[i]) % maglevSize
+				for table[c] != nil {
+					next[i]++
+					c = (offsets[i] + next[i]*skips[i]) % maglevSize
+				}
+				table[c] = n
+				next[i]++
+				filled++
+				if filled == maglevSize {
+					return table
+				}
+			}
+		}
+	}
+}
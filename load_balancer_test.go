@@ -0,0 +1,228 @@
+package gproxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testNodes(weights []int) ([]*node, []string) {
+	nodes := make([]*node, len(weights))
+	names := make([]string, len(weights))
+	for i, w := range weights {
+		names[i] = "http://10.0.0." + strconv.Itoa(i+1) + ":8080"
+		nodes[i] = &node{ew: w, id: i}
+	}
+	return nodes, names
+}
+
+func userRequest(user string) *http.Request {
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if user != "" {
+		req.Header.Set("X-User", user)
+	}
+	return req
+}
+
+// picks 返回每个 node 被选中的次数
+func picks(bl balancer, nodes []*node, n int, req func(i int) *http.Request) []int {
+	counts := make([]int, len(nodes))
+	for i := 0; i < n; i++ {
+		counts[bl.pick(nodes, req(i)).id]++
+	}
+	return counts
+}
+
+func anyRequest(int) *http.Request { return userRequest("") }
+
+func userRequests(i int) *http.Request { return userRequest("user-" + strconv.Itoa(i)) }
+
+// checkWeights 检查选中的次数和权重成比例, 误差不超过 tolerance
+func checkWeights(t *testing.T, name string, counts, weights []int, tolerance float64) {
+	t.Helper()
+	var total, tw int
+	for i := range counts {
+		total += counts[i]
+		tw += weights[i]
+	}
+	for i, c := range counts {
+		want := float64(total) * float64(weights[i]) / float64(tw)
+		if math.Abs(float64(c)-want) > want*tolerance {
+			t.Errorf("%s: node %d picked %d times, want %.0f (weights %v, counts %v)", name, i, c, want, weights, counts)
+		}
+	}
+}
+
+func TestSWRR(t *testing.T) {
+	nodes, names := testNodes([]int{5, 1, 1})
+	bl, _ := newBalancer("swrr", "", names, []int{5, 1, 1})
+	// nginx 的平滑加权轮询: a a b a c a a
+	var seq []int
+	for i := 0; i < 7; i++ {
+		seq = append(seq, bl.pick(nodes, anyRequest(i)).id)
+	}
+	want := []int{0, 0, 1, 0, 2, 0, 0}
+	for i := range want {
+		if seq[i] != want[i] {
+			t.Fatalf("sequence %v, want %v", seq, want)
+		}
+	}
+	checkWeights(t, "swrr", picks(bl, nodes, 7000, anyRequest), []int{5, 1, 1}, 0)
+}
+
+func TestLeastConn(t *testing.T) {
+	weights := []int{1, 2, 1}
+	nodes, names := testNodes(weights)
+	bl, _ := newBalancer("leastconn", "", names, weights)
+	// conns/weight: 2, 1, 3
+	nodes[0].conns, nodes[1].conns, nodes[2].conns = 2, 2, 3
+	if n := bl.pick(nodes, anyRequest(0)); n.id != 1 {
+		t.Fatalf("picked %d, want 1", n.id)
+	}
+	// 相同时按权重轮询
+	for _, n := range nodes {
+		n.conns = 0
+	}
+	checkWeights(t, "leastconn", picks(bl, nodes, 4000, anyRequest), weights, 0)
+}
+
+func TestP2C(t *testing.T) {
+	nodes, names := testNodes([]int{1, 1, 1})
+	bl, _ := newBalancer("p2c", "", names, []int{1, 1, 1})
+	nodes[0].ewma = float64(time.Millisecond)
+	nodes[1].ewma = float64(5 * time.Millisecond)
+	nodes[2].ewma = float64(10 * time.Millisecond)
+	counts := picks(bl, nodes, 30000, anyRequest)
+	// 最慢的永远不会被选中, 最快的只要被抽到就被选中
+	if counts[2] != 0 {
+		t.Errorf("slowest node picked %d times", counts[2])
+	}
+	checkWeights(t, "p2c", counts[:2], []int{2, 1}, 0.05)
+
+	// 请求数多的 node cost 变大
+	nodes[0].conns = 19
+	if counts := picks(bl, nodes, 3000, anyRequest); counts[0] != 0 {
+		t.Errorf("busy node picked %d times, counts %v", counts[0], counts)
+	}
+	// 还没有响应时间的 node 优先
+	nodes[2].ewma = 0
+	if counts := picks(bl, nodes, 3000, anyRequest); counts[2] < 1800 {
+		t.Errorf("unmeasured node picked %d times, counts %v", counts[2], counts)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	weights := []int{1, 2, 3, 2}
+	for _, name := range []string{"ring", "maglev"} {
+		nodes, names := testNodes(weights)
+		bl, err := newBalancer(name, "header:X-User", names, weights)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const users = 20000
+		before := make([]int, users)
+		counts := make([]int, len(nodes))
+		for i := range before {
+			before[i] = bl.pick(nodes, userRequests(i)).id
+			counts[before[i]]++
+		}
+		checkWeights(t, name, counts, weights, 0.15)
+		// 同一个 key 总是选中同一个 node
+		for i := 0; i < 100; i++ {
+			if id := bl.pick(nodes, userRequests(i)).id; id != before[i] {
+				t.Fatalf("%s: user-%d moved from %d to %d", name, i, before[i], id)
+			}
+		}
+		// 去掉一个 node 之后, 其它 node 上的 key 基本不动
+		avail := append([]*node{nodes[0]}, nodes[2:]...)
+		var moved, kept int
+		for i := range before {
+			id := bl.pick(avail, userRequests(i)).id
+			if id == 1 {
+				t.Fatalf("%s: picked unavailable node", name)
+			}
+			if before[i] == 1 {
+				continue
+			}
+			if id == before[i] {
+				kept++
+			} else {
+				moved++
+			}
+		}
+		if moved > (moved+kept)/20 {
+			t.Errorf("%s: %d of %d keys moved after removing another node", name, moved, moved+kept)
+		}
+		// 没有 key 时按权重轮询
+		for _, n := range nodes {
+			n.cw = 0
+		}
+		checkWeights(t, name+" without key", picks(bl, nodes, 8000, anyRequest), weights, 0)
+	}
+}
+
+// 所有算法使用同一个 pool: 权重不同, 请求数和响应时间也不同
+var benchWeights = []int{5, 1, 1, 3, 2, 4, 1, 3}
+
+func benchPool() ([]*node, []string) {
+	nodes := make([]*node, len(benchWeights))
+	names := make([]string, len(benchWeights))
+	for i, w := range benchWeights {
+		names[i] = "http://10.0.0." + strconv.Itoa(i+1) + ":8080"
+		nodes[i] = &node{
+			ew:    w,
+			id:    i,
+			conns: i % 4,
+			ewma:  float64(time.Duration(i+1) * time.Millisecond),
+		}
+	}
+	return nodes, names
+}
+
+func benchRequests() []*http.Request {
+	reqs := make([]*http.Request, 1024)
+	for i := range reqs {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("X-User", "user-"+strconv.Itoa(i))
+		reqs[i] = req
+	}
+	return reqs
+}
+
+func benchBalancer(b *testing.B, name string) {
+	nodes, names := benchPool()
+	bl, err := newBalancer(name, "header:X-User", names, benchWeights)
+	if err != nil {
+		b.Fatal(err)
+	}
+	reqs := benchRequests()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if bl.pick(nodes, reqs[i%len(reqs)]) == nil {
+			b.Fatal("no node picked")
+		}
+	}
+}
+
+func BenchmarkSWRR(b *testing.B) {
+	benchBalancer(b, "swrr")
+}
+
+func BenchmarkLeastConn(b *testing.B) {
+	benchBalancer(b, "leastconn")
+}
+
+func BenchmarkRing(b *testing.B) {
+	benchBalancer(b, "ring")
+}
+
+func BenchmarkMaglev(b *testing.B) {
+	benchBalancer(b, "maglev")
+}
+
+func BenchmarkP2C(b *testing.B) {
+	benchBalancer(b, "p2c")
+}
@@ -0,0 +1,76 @@
+package gproxy
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// MapLocalRule answers matched requests with a local file or directory
+type MapLocalRule struct {
+	Match Match `json:"match"`
+	// 文件或者目录, 目录时用请求的路径查找文件
+	Path string `json:"path"`
+	// 目录时先去掉请求路径的前缀, 比如 /static/
+	StripPrefix string `json:"stripPrefix,omitempty"`
+}
+
+func (r *Rules) matchMapLocal(req *http.Request) *MapLocalRule {
+	for _, rule := range r.MapLocal {
+		if rule.Match.match(req) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves the local file
+func (m *MapLocalRule) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	fi, err := os.Stat(m.Path)
+	if err != nil {
+		mapLocalError(rw, err)
+		return
+	}
+	name := "/" + filepath.Base(m.Path)
+	var fs http.FileSystem = http.Dir(filepath.Dir(m.Path))
+	if fi.IsDir() {
+		// http.Dir 不允许访问目录以外的文件
+		name = path.Clean("/" + strings.TrimPrefix(req.URL.Path, m.StripPrefix))
+		if strings.HasSuffix(req.URL.Path, "/") {
+			name = path.Join(name, "index.html")
+		}
+		fs = http.Dir(m.Path)
+	}
+	fp, err := fs.Open(name)
+	if err != nil {
+		mapLocalError(rw, err)
+		return
+	}
+	defer fp.Close()
+	if fi, err = fp.Stat(); err != nil {
+		mapLocalError(rw, err)
+		return
+	}
+	if fi.IsDir() {
+		http.NotFound(rw, req)
+		return
+	}
+	logger.Printf("map local %s %s", req.URL, name)
+	rw.Header().Set("Etag", fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()))
+	// 处理 Range, If-None-Match, If-Modified-Since 以及 Content-Type
+	http.ServeContent(rw, req, name, fi.ModTime(), fp)
+}
+
+func mapLocalError(rw http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err):
+		http.Error(rw, "404 page not found", http.StatusNotFound)
+	case os.IsPermission(err):
+		http.Error(rw, "403 Forbidden", http.StatusForbidden)
+	default:
+		http.Error(rw, "500 Internal Server Error", http.StatusInternalServerError)
+	}
+}
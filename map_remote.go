@@ -0,0 +1,104 @@
+package gproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// MapRemoteRule sends matched requests to a different upstream,
+// From 和 To 是 url 前缀, 比如 https://api.example.com/v2/ 和 http://localhost:3000/v2/,
+// 省略的 scheme 和端口匹配任意值, host 支持 *.example.com 这样的通配
+type MapRemoteRule struct {
+	// 额外的匹配条件, 可以为空
+	Match Match  `json:"match"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	// 保留原来的 Host header, 默认使用 To 的 host
+	PreserveHost bool `json:"preserveHost,omitempty"`
+
+	from, to *url.URL
+}
+
+func (m *MapRemoteRule) compile() (err error) {
+	if err = m.Match.compile(); err != nil {
+		return
+	}
+	if m.from, err = parsePrefix(m.From); err != nil {
+		return
+	}
+	m.to, err = parsePrefix(m.To)
+	return
+}
+
+// parsePrefix 允许省略 scheme, 比如 api.example.com/v2/
+func parsePrefix(rawurl string) (*url.URL, error) {
+	if !strings.Contains(rawurl, "://") {
+		rawurl = "//" + rawurl
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("map remote: missing host in %q", rawurl)
+	}
+	return u, nil
+}
+
+func (r *Rules) matchMapRemote(req *http.Request) *MapRemoteRule {
+	for _, rule := range r.MapRemote {
+		if rule.match(req) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (m *MapRemoteRule) match(req *http.Request) bool {
+	from, u := m.from, req.URL
+	if from.Scheme != "" && !strings.EqualFold(from.Scheme, u.Scheme) {
+		return false
+	}
+	if !matchHost(from.Hostname(), u.Hostname()) {
+		return false
+	}
+	if from.Port() != "" && from.Port() != urlPort(u) {
+		return false
+	}
+	if !strings.HasPrefix(u.Path, from.Path) {
+		return false
+	}
+	return m.Match.match(req)
+}
+
+func (m *MapRemoteRule) rewrite(req *http.Request) {
+	from, to, u := m.from, m.to, req.URL
+	old := u.String()
+	if to.Scheme != "" {
+		u.Scheme = to.Scheme
+	}
+	u.Host = to.Host
+	u.Path = to.Path + strings.TrimPrefix(u.Path, from.Path)
+	if !strings.HasPrefix(u.Path, "/") {
+		u.Path = "/" + u.Path
+	}
+	u.RawPath = ""
+	if !m.PreserveHost {
+		// 为空时 Transport 使用 URL.Host
+		req.Host = ""
+	}
+	logger.Printf("map remote %s %s", old, u)
+}
+
+// urlPort 返回 url 的端口, 没有时返回 scheme 的默认端口
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if strings.EqualFold(u.Scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
@@ -0,0 +1,53 @@
+package gproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// 添加 map remote 之后, 其他规则仍然匹配原来的 url
+func TestMapRemoteMatchOriginalURL(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Path", req.URL.Path)
+		rw.Header().Set("X-Rewrite", req.Header.Get("X-Rewrite"))
+	}))
+	defer backend.Close()
+
+	rules := &Rules{
+		Rewrite: []*RewriteRule{{
+			Match:    Match{Host: "api.example.com"},
+			Request:  &RewriteAction{SetHeader: map[string]string{"X-Rewrite": "request"}},
+			Response: &RewriteAction{SetHeader: map[string]string{"X-Response": "response"}},
+		}},
+		MapRemote: []*MapRemoteRule{{From: "api.example.com/v1/", To: backend.URL + "/v2/"}},
+	}
+	if err := rules.compile(); err != nil {
+		t.Fatal(err)
+	}
+	ph := NewProxyHandler()
+	ph.Rules = rules
+	ps := httptest.NewServer(ph)
+	defer ps.Close()
+	proxyURL, _ := url.Parse(ps.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	res, err := client.Get("http://api.example.com/v1/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", res.StatusCode)
+	}
+	for k, want := range map[string]string{
+		"X-Path":     "/v2/users",
+		"X-Rewrite":  "request",
+		"X-Response": "response",
+	} {
+		if got := res.Header.Get(k); got != want {
+			t.Errorf("%s = %q, want %q", k, got, want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package gproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NetworkProfile simulates a slow or lossy network on client connections
+type NetworkProfile struct {
+	Name string `json:"name"`
+	// 下行(发给客户端)和上行(客户端发来)的带宽, bytes/s, 0 不限制
+	Down uint `json:"down"`
+	Up   uint `json:"up"`
+	// 每个来回增加的延迟, 再加上 [-Jitter, Jitter] 的随机抖动
+	Latency Duration `json:"latency"`
+	Jitter  Duration `json:"jitter"`
+	// 建立连接的延迟
+	Setup Duration `json:"setup"`
+	// 丢包的概率, 丢包时等待一次重传的时间
+	Loss float64 `json:"loss"`
+}
+
+// 丢包之后 tcp 最少等待 200ms 重传
+const minRTO = 200 * time.Millisecond
+
+// Profiles are the builtin network profiles
+var Profiles = map[string]*NetworkProfile{
+	"2g": {
+		Name:    "2g",
+		Down:    250 * 1000 / 8,
+		Up:      50 * 1000 / 8,
+		Latency: Duration(300 * time.Millisecond),
+		Jitter:  Duration(100 * time.Millisecond),
+		Setup:   Duration(time.Second),
+	},
+	"3g": {
+		Name:    "3g",
+		Down:    1600 * 1000 / 8,
+		Up:      750 * 1000 / 8,
+		Latency: Duration(150 * time.Millisecond),
+		Jitter:  Duration(50 * time.Millisecond),
+		Setup:   Duration(500 * time.Millisecond),
+	},
+	"4g": {
+		Name:    "4g",
+		Down:    12 * 1000 * 1000 / 8,
+		Up:      4 * 1000 * 1000 / 8,
+		Latency: Duration(40 * time.Millisecond),
+		Jitter:  Duration(10 * time.Millisecond),
+		Setup:   Duration(100 * time.Millisecond),
+	},
+	"wifi-lossy": {
+		Name:    "wifi-lossy",
+		Down:    5 * 1000 * 1000 / 8,
+		Up:      2 * 1000 * 1000 / 8,
+		Latency: Duration(20 * time.Millisecond),
+		Jitter:  Duration(80 * time.Millisecond),
+		Setup:   Duration(50 * time.Millisecond),
+		Loss:    0.05,
+	},
+}
+
+// LookupProfile returns the builtin profile by name
+func LookupProfile(name string) (*NetworkProfile, error) {
+	p, ok := Profiles[strings.ToLower(name)]
+	if !ok {
+		names := make([]string, 0, len(Profiles))
+		for name := range Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown network profile %q, available: %s", name, strings.Join(names, ", "))
+	}
+	return p, nil
+}
+
+// delay 返回一次来回增加的延迟
+func (p *NetworkProfile) delay() time.Duration {
+	d := time.Duration(p.Latency)
+	if j := int64(p.Jitter); j > 0 {
+		d += time.Duration(rand.Int63n(2*j+1) - j)
+	}
+	if p.Loss > 0 && rand.Float64() < p.Loss {
+		d += minRTO + time.Duration(p.Latency)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// Conn returns c with the profile applied
+func (p *NetworkProfile) Conn(c net.Conn) net.Conn {
+	return &shapedConn{
+		Conn:    c,
+		rw:      NewRateReadWriter(c, p.Up, p.Down),
+		profile: p,
+	}
+}
+
+// Listener applies the profile to every accepted connection
+func (p *NetworkProfile) Listener(ln net.Listener) net.Listener {
+	return &shapedListener{Listener: ln, profile: p}
+}
+
+type shapedListener struct {
+	net.Listener
+	profile *NetworkProfile
+}
+
+func (ln *shapedListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return ln.profile.Conn(c), nil
+}
+
+// shapedConn 读写限速, 读到数据之后的第一次写等待一次来回的延迟
+type shapedConn struct {
+	net.Conn
+	rw      *RateReader
+	profile *NetworkProfile
+	setup   sync.Once
+	mu      sync.Mutex
+	pending bool
+}
+
+func (c *shapedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *shapedConn) wait() {
+	c.setup.Do(func() {
+		time.Sleep(time.Duration(c.profile.Setup))
+	})
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	c.wait()
+	n, err := c.rw.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		c.pending = true
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	c.wait()
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = false
+	c.mu.Unlock()
+	if pending {
+		time.Sleep(c.profile.delay())
+	}
+	return c.rw.Write(p)
+}
+
+// shapeRequest 用于普通 http 请求, 连接由 http.Server 管理, 只模拟带宽和延迟
+func (p *NetworkProfile) shapeRequest(rw http.ResponseWriter, req *http.Request) (http.ResponseWriter, *http.Request) {
+	if err := sleep(req.Context(), p.delay()); err != nil {
+		return rw, req
+	}
+	if req.Body != nil && req.Body != http.NoBody && p.Up > 0 {
+		req.Body = &shapedBody{
+			ReadCloser: req.Body,
+			r:          NewRateReadWriter(readOnly{req.Body}, p.Up, 0),
+		}
+	}
+	if p.Down == 0 {
+		return rw, req
+	}
+	return &shapedWriter{
+		ResponseWriter: rw,
+		w:              NewRateReadWriter(writeOnly{rw}, 0, p.Down),
+		wrap:           p.Conn,
+	}, req
+}
+
+type shapedBody struct {
+	io.ReadCloser
+	r io.Reader
+}
+
+func (b *shapedBody) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+type readOnly struct{ io.Reader }
+
+func (readOnly) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+type writeOnly struct{ io.Writer }
+
+func (writeOnly) Read(p []byte) (int, error) { return 0, io.EOF }
+
+type shapedWriter struct {
+	http.ResponseWriter
+	w io.Writer
+	// 包装 Hijack 返回的连接
+	wrap func(net.Conn) net.Conn
+}
+
+func (w *shapedWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+func (w *shapedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack 之后的连接同样需要限速, 比如 websocket
+func (w *shapedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errHijack
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return w.wrap(conn), brw, nil
+}
+
+func (w *shapedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
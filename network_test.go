@@ -0,0 +1,42 @@
+package gproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Listener 接受的连接第一次读写之前等待 Setup
+func TestProfileListenerSetup(t *testing.T) {
+	p := &NetworkProfile{Name: "setup", Setup: Duration(300 * time.Millisecond)}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = p.Listener(ln)
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	c.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < time.Duration(p.Setup) {
+		t.Fatalf("echo after %s, want at least %s", d, time.Duration(p.Setup))
+	}
+}
@@ -1,6 +1,7 @@
 package gproxy
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -9,9 +10,15 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/net/http2"
 )
 
+// Version is the version of gproxy
+const Version = "0.1.0"
+
 var (
 	errCert         = errors.New("invail cert file or hosts")
 	errServerClosed = errors.New("server closed")
@@ -25,27 +32,179 @@ type ProxyHandler struct {
 	BufferPool *BufferPool
 	// 用来处理http
 	Handler http.Handler
-	hosts   map[string]struct{}
-	mu      sync.Mutex
+	// 设置了 ca 之后所有的 https 请求都会参与握手
+	Certs *CertStore
+	// 记录 h2 连接的 frame, nil 不记录
+	H2View *H2View
+	// 记录请求和响应, nil 不记录
+	Flows *FlowStore
+	// 用记录的响应代替上游, nil 不使用
+	Snapshot *Snapshot
+	// 请求/响应改写规则, nil 不使用
+	Rules *Rules
+	// 暂停匹配 Rules.Breakpoints 的请求, nil 不使用
+	Breakpoints *Breakpoints
+	// javascript hooks, nil 不使用
+	Scripts *Scripts
+	// 模拟 2G/3G/4G 等网络, nil 不使用; 普通 http 的连接由 http.Server 管理,
+	// 不模拟建立连接的延迟, 自己监听时用 NetworkProfile.Listener 代替
+	Profile *NetworkProfile
+
+	upstream *upstream
+	hosts    map[string]struct{}
+	mu       sync.Mutex
+
+	// Hijack 之后 http.Server 不再管理的连接, 以及升级之后的上游连接
+	inShutdown int32
+	connMu     sync.Mutex
+	conns      map[io.Closer]struct{}
+	servers    map[*http.Server]struct{}
+	// 关闭 h2base 时 h2s 的连接发送 GOAWAY
+	h2s    *http2.Server
+	h2base *http.Server
 }
 
 // NewProxyHandler returns a new ProxyHandler
 func NewProxyHandler() *ProxyHandler {
 	var tp = defaultTransport()
+	up := newUpstream(tp)
 	// ReverseProxy 已经足够用来代理普通http
 	rp := &httputil.ReverseProxy{
-		Transport:  tp,
-		BufferPool: defaultBufferPool,
-		ErrorLog:   logger,
-		Director:   director,
+		BufferPool:   defaultBufferPool,
+		ErrorLog:     logger,
+		ErrorHandler: proxyError,
 	}
-	return &ProxyHandler{
+	ph := &ProxyHandler{
 		Transport:  tp,
 		Handler:    rp,
 		BufferPool: defaultBufferPool,
+		upstream:   up,
+		h2s:        &http2.Server{IdleTimeout: idleTimeout},
+		h2base:     &http.Server{ErrorLog: logger},
+	}
+	rp.Director = director
+	rp.Transport = roundTripperFunc(ph.roundTrip)
+	http2.ConfigureServer(ph.h2base, ph.h2s)
+	return ph
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// roundTrip 是 Handler 使用的 Transport, 应用 rules, snapshot 等再交给 ph.Transport,
+// 所有规则都匹配原来的请求, 最后才把匹配 map remote 的请求转到别的上游
+func (ph *ProxyHandler) roundTrip(req *http.Request) (*http.Response, error) {
+	var rewrites []*RewriteRule
+	var bp *BreakpointRule
+	var wsRules []*WebSocketRule
+	var remote *MapRemoteRule
+	if rules := ph.Rules; rules != nil {
+		rewrites = rules.matchRewrite(req)
+		if ph.Breakpoints != nil {
+			bp = rules.matchBreakpoint(req)
+		}
+		wsRules = rules.matchWebSocket(req)
+		remote = rules.matchMapRemote(req)
+	}
+	ws := isWebSocket(req.Header)
+	if ws && (ph.Flows != nil || len(wsRules) > 0) {
+		// 不协商 permessage-deflate, 才能看到 frame 的内容
+		req.Header.Del("Sec-WebSocket-Extensions")
+	}
+	for _, rule := range rewrites {
+		if rule.Request == nil {
+			continue
+		}
+		if err := rule.Request.rewriteRequest(req); err != nil {
+			return nil, err
+		}
+	}
+	if s := ph.Scripts; s != nil {
+		res, err := s.request(req)
+		if res != nil || err != nil {
+			return res, err
+		}
+	}
+	if bp != nil && bp.Request {
+		res, err := ph.Breakpoints.breakRequest(req, bp)
+		if res != nil || err != nil {
+			return res, err
+		}
+	}
+	if remote != nil {
+		remote.rewrite(req)
+	}
+	res, err := ph.send(req)
+	if err != nil {
+		return nil, err
 	}
+	// 升级之后的 body 是连接, 不能读取
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		// ReverseProxy 把 101 直接写到 Hijack 的连接上, captureWriter 记录不到
+		if f := flowFromContext(req.Context()); f != nil {
+			f.Response = &FlowResponse{
+				StatusCode: res.StatusCode,
+				Proto:      res.Proto,
+				Header:     cloneHeader(res.Header),
+			}
+		}
+		if ws {
+			res = ph.websocket(res, wsRules)
+		}
+		// 普通 http 升级的连接被 ReverseProxy Hijack, http.Server.Shutdown 不会等待
+		if rwc, ok := res.Body.(io.ReadWriteCloser); ok {
+			res.Body = newUpgradedConn(ph, rwc)
+		}
+		return res, nil
+	}
+	for _, rule := range rewrites {
+		if rule.Response == nil {
+			continue
+		}
+		if err := rule.Response.rewriteResponse(res); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+	}
+	if s := ph.Scripts; s != nil {
+		if err := s.response(res); err != nil {
+			return nil, err
+		}
+	}
+	if bp != nil && bp.Response {
+		return ph.Breakpoints.breakResponse(res, bp)
+	}
+	return res, nil
+}
+
+func (ph *ProxyHandler) send(req *http.Request) (*http.Response, error) {
+	if s := ph.Snapshot; s != nil {
+		res, err := s.roundTrip(req)
+		if _, miss := err.(*snapshotMiss); !miss || !s.Fallthrough {
+			return res, err
+		}
+	}
+	if up := ph.upstream; up != nil && ph.Transport == http.RoundTripper(up.transport) && isWebSocket(req.Header) {
+		return up.h1Transport().RoundTrip(req)
+	}
+	return ph.Transport.RoundTrip(req)
+}
+
+// 使用 snapshot 并且不允许访问上游
+func (ph *ProxyHandler) offline() bool {
+	return ph.Snapshot != nil && !ph.Snapshot.Fallthrough
 }
 
+const (
+	handshakeTimeout = 10 * time.Second
+	idleTimeout      = 90 * time.Second
+	// 和 http.Server.Shutdown 一样轮询连接的状态
+	shutdownPollInterval = 500 * time.Millisecond
+)
+
 // 先固定是10s
 var dialer = &net.Dialer{
 	Timeout:   10 * time.Second,
@@ -54,7 +213,7 @@ var dialer = &net.Dialer{
 }
 
 // http.DefaultTransport
-func defaultTransport() http.RoundTripper {
+func defaultTransport() *http.Transport {
 	return &http.Transport{
 		Proxy:                 http.ProxyFromEnvironment,
 		DialContext:           dialer.DialContext,
@@ -62,12 +221,25 @@ func defaultTransport() http.RoundTripper {
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
-		// @TODO DialTLS 并行Handshake加快首次连接速度 (但需要配置h2)
 	}
 }
 
+// map remote 在 roundTrip 里 send 之前处理, 其他规则都匹配原来的 url
 func director(req *http.Request) {}
 
+func proxyError(rw http.ResponseWriter, req *http.Request, err error) {
+	logger.Printf("http error: %s %s", req.URL, err)
+	if f := flowFromContext(req.Context()); f != nil {
+		f.Error = err.Error()
+	}
+	if err == errDropped {
+		// 只在 handler 里中断, http.Server 关闭连接, h2 reset stream
+		panic(http.ErrAbortHandler)
+	}
+	rw.WriteHeader(http.StatusBadGateway)
+	fmt.Fprintf(rw, "502 Bad Gateway\n%s\n", err)
+}
+
 // SetCert update certificate and hosts for tls handshake
 func (ph *ProxyHandler) SetCert(hosts []string, certFile, keyFile string) (err error) {
 	if certFile == "" || keyFile == "" || len(hosts) == 0 {
@@ -79,16 +251,8 @@ func (ph *ProxyHandler) SetCert(hosts []string, certFile, keyFile string) (err e
 		return
 	}
 	ph.mu.Lock()
-	ph.TLSConfig = &tls.Config{
-		MinVersion:               tls.VersionTLS12,
-		Certificates:             certificates,
-		PreferServerCipherSuites: true,
-		ClientSessionCache:       tls.NewLRUClientSessionCache(16),
-		SessionTicketsDisabled:   false,
-		Renegotiation:            tls.RenegotiateNever,
-		// @TODO 两边协商一致
-		NextProtos: []string{"http/1.1", "h2"},
-	}
+	ph.TLSConfig = newServerTLSConfig()
+	ph.TLSConfig.Certificates = certificates
 	if ph.hosts == nil {
 		ph.hosts = make(map[string]struct{}, len(hosts))
 	}
@@ -99,7 +263,74 @@ func (ph *ProxyHandler) SetCert(hosts []string, certFile, keyFile string) (err e
 	return
 }
 
+// SetCA update root ca, leaf certificates will be signed for every host on demand
+func (ph *ProxyHandler) SetCA(certFile, keyFile string) error {
+	ca, err := LoadCA(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	ph.mu.Lock()
+	ph.Certs = NewCertStore(ca)
+	if ph.TLSConfig == nil {
+		ph.TLSConfig = newServerTLSConfig()
+	}
+	ph.mu.Unlock()
+	return nil
+}
+
+func newServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: true,
+		ClientSessionCache:       tls.NewLRUClientSessionCache(16),
+		SessionTicketsDisabled:   false,
+		Renegotiation:            tls.RenegotiateNever,
+		NextProtos:               []string{"h2", "http/1.1"},
+	}
+}
+
+// 每个连接一个 tls.Config, 客户端没有 SNI 时用 CONNECT 的 host 签发证书
+func (ph *ProxyHandler) serverTLSConfig(host, addr string) *tls.Config {
+	ph.mu.Lock()
+	config, certs := ph.TLSConfig, ph.Certs
+	ph.mu.Unlock()
+	config = config.Clone()
+	// 和客户端握手的同时连接上游, 只提供上游也支持的协议
+	if up := ph.upstream; up != nil && ph.Transport == http.RoundTripper(up.transport) && !ph.offline() {
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c := config.Clone()
+			c.GetConfigForClient = nil
+			c.NextProtos = up.alpn(sniAddr(addr, hello.ServerName), hello.SupportedProtos)
+			return c, nil
+		}
+	}
+	if certs == nil {
+		return config
+	}
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := hello.ServerName
+		// 静态证书里的域名优先
+		if name != "" && len(config.Certificates) > 0 && ph.contains(name) {
+			return &config.Certificates[0], nil
+		}
+		if name == "" {
+			name = host
+		}
+		return certs.Get(name)
+	}
+	return config
+}
+
+// certStore 返回 SetCA 设置的 CertStore
+func (ph *ProxyHandler) certStore() *CertStore {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	return ph.Certs
+}
+
 func (ph *ProxyHandler) contains(host string) bool {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
 	if _, ok := ph.hosts[host]; ok {
 		return true
 	}
@@ -111,7 +342,49 @@ func (ph *ProxyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		ph.connect(rw, req)
 		return
 	}
+	if p := ph.Profile; p != nil {
+		rw, req = p.shapeRequest(rw, req)
+	}
+	if rules := ph.Rules; rules != nil && len(rules.Limits) > 0 {
+		rw, req = limitRequest(rules.Limits, rw, req)
+	}
+	ph.serve(rw, req)
+}
+
+// 普通 http 和参与握手的 https 请求都从这里处理
+func (ph *ProxyHandler) serve(rw http.ResponseWriter, req *http.Request) {
 	logger.Printf("%s %s", req.Method, req.URL)
+	store := ph.Flows
+	if store == nil {
+		ph.handle(rw, req)
+		return
+	}
+	c := newCapture(store.nextID(), req, store.maxBodySize())
+	cw := &captureWriter{ResponseWriter: rw, c: c, store: store}
+	defer cw.add()
+	ph.handle(cw, c.wrap(req))
+}
+
+// handle 本地有对应的文件时不再请求上游
+func (ph *ProxyHandler) handle(rw http.ResponseWriter, req *http.Request) {
+	if rules := ph.Rules; rules != nil {
+		f := rules.matchFault(req, func(f *FaultRule) bool {
+			return f.Fault != "corrupt"
+		})
+		if f != nil && f.Fault == "status" {
+			f.serveStatus(rw, req)
+			return
+		}
+		if f != nil {
+			fw := &faultWriter{ResponseWriter: rw, req: req, fault: f}
+			defer fw.abort()
+			rw = fw
+		}
+		if m := rules.matchMapLocal(req); m != nil {
+			m.ServeHTTP(rw, req)
+			return
+		}
+	}
 	ph.Handler.ServeHTTP(rw, req)
 }
 
@@ -123,6 +396,18 @@ func (ph *ProxyHandler) connect(rw http.ResponseWriter, req *http.Request) {
 		fmt.Fprintln(rw, "502 Bad Gateway")
 		return
 	}
+	if ph.shuttingDown() {
+		rw.WriteHeader(503)
+		fmt.Fprintln(rw, "503 Service Unavailable")
+		return
+	}
+	addr := host + ":" + port
+	intercept, status := ph.connectMode(host, addr, ph.certStore() != nil || ph.contains(host))
+	if status != 0 {
+		rw.WriteHeader(status)
+		fmt.Fprintf(rw, "%d %s\n", status, http.StatusText(status))
+		return
+	}
 	hj, ok := rw.(http.Hijacker)
 	if !ok {
 		logger.Println("connect hijacking not support")
@@ -135,16 +420,63 @@ func (ph *ProxyHandler) connect(rw http.ResponseWriter, req *http.Request) {
 		httpError(conn, err)
 		return
 	}
-
-	addr := host + ":" + port
+	ph.trackConn(conn, true)
+	defer ph.trackConn(conn, false)
+	conn = ph.wrapConn(conn, host, req.RemoteAddr)
 	conn.Write(http200)
-	if ph.contains(host) {
-		ph.tls(addr, conn)
+	conn = ph.faultConn(conn, req, addr, intercept)
+	if intercept {
+		ph.tls(host, addr, conn)
 	} else {
 		ph.tunnel(addr, conn)
 	}
 }
 
+// connectMode 应用 onConnect 脚本和 snapshot, 返回是否参与握手, status 不为 0 时拒绝连接
+func (ph *ProxyHandler) connectMode(host, addr string, intercept bool) (bool, int) {
+	if s := ph.Scripts; s != nil {
+		allow, tunnel := s.connect(host)
+		if !allow {
+			logger.Printf("script refuse connect %s \n", addr)
+			return false, http.StatusForbidden
+		}
+		if tunnel {
+			intercept = false
+		}
+	}
+	if !intercept && ph.offline() {
+		// 不参与握手就没办法从 snapshot 响应
+		logger.Printf("snapshot refuse tunnel %s \n", addr)
+		return false, http.StatusBadGateway
+	}
+	return intercept, 0
+}
+
+// wrapConn 对客户端连接应用网络模拟和限速
+func (ph *ProxyHandler) wrapConn(conn net.Conn, host, remoteAddr string) net.Conn {
+	if p := ph.Profile; p != nil {
+		conn = p.Conn(conn)
+	}
+	if rules := ph.Rules; rules != nil && len(rules.Limits) > 0 {
+		down, up := matchLimits(rules.Limits, host, clientIP(remoteAddr))
+		conn = newLimitedConn(conn, down, up)
+	}
+	return conn
+}
+
+// faultConn 需要在代理的响应之后包装, 参与握手的连接在 http 响应里处理, 这里只处理 corrupt
+func (ph *ProxyHandler) faultConn(conn net.Conn, req *http.Request, addr string, intercept bool) net.Conn {
+	if rules := ph.Rules; rules != nil && len(rules.Faults) > 0 {
+		f := rules.matchFault(req, func(f *FaultRule) bool {
+			return f.Fault == "corrupt" || !intercept && f.Fault != "status"
+		})
+		if f != nil {
+			conn = newFaultConn(conn, f, addr)
+		}
+	}
+	return conn
+}
+
 // 直接转发的 tls 连接
 func (ph *ProxyHandler) tunnel(addr string, conn net.Conn) {
 	logger.Printf("connect tunnel %s \n", addr)
@@ -166,6 +498,7 @@ func (ph *ProxyHandler) tunnel(addr string, conn net.Conn) {
 	}
 }
 
+// tunnel 双向转发, buf 用于上行; 两端都包装过的连接不能 splice, 两个方向不能共用一个 buf
 func tunnel(user, backend net.Conn, buf []byte) error {
 	errc := make(chan error, 1)
 	spc := copier{
@@ -174,41 +507,215 @@ func tunnel(user, backend net.Conn, buf []byte) error {
 		buf:     buf,
 	}
 	go spc.copyToBackend(errc)
-	go spc.copyFromBackend(errc)
+	go func() {
+		// 另一个方向的 buf 在 copy 结束之后才放回去, tunnel 返回时可能还在用
+		down := defaultBufferPool.Get()
+		defer defaultBufferPool.Put(down)
+		copier{user: user, backend: backend, buf: down}.copyFromBackend(errc)
+	}()
 	return <-errc
 }
 
-// http1.1 参与握手的 tls 连接,这里先简单处理
-func (ph *ProxyHandler) tls(addr string, conn net.Conn) {
-	srv := tls.Server(conn, ph.TLSConfig)
-	br := newBufioReader(srv)
-	defer func() {
+// 参与握手的 tls 连接, h2 交给 http2.Server,
+// http1.1 交给 http.Server 处理 keep-alive, pipelining, chunked, 100-continue
+func (ph *ProxyHandler) tls(host, addr string, conn net.Conn) {
+	srv := tls.Server(conn, ph.serverTLSConfig(host, addr))
+	srv.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := srv.Handshake(); err != nil {
+		logger.Printf("tls handshake %s %s \n", addr, err)
 		srv.Close()
-		putBufioReader(br)
-	}()
-
-	// @TODO http2/http1.1 for { 多次read }
-	// @TODO,并行 tls handshake
-	// @TODO,tcp tunnel,解析copy不阻碍速度io.MultiWriter
-	// @TODO,两端h2协商不一致问题
-	req, err := http.ReadRequest(br)
-	if err != nil {
-		httpError(srv, err)
 		return
 	}
-	req.URL.Host = addr
-	req.URL.Scheme = "https"
-	// 因为第一次到这里需要等待两次握手时间,
-	// transport还没有加入到connections pool,会很慢
-	res, err := ph.Transport.RoundTrip(req)
-	if err != nil {
-		httpError(srv, err)
+	srv.SetDeadline(time.Time{})
+	addr = sniAddr(addr, srv.ConnectionState().ServerName)
+	if srv.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		ph.h2(addr, srv)
 		return
 	}
-	res.Header.Set("Connection", "close")
-	logger.Printf("%s %s %d\n", req.Method, req.URL, res.StatusCode)
-	res.Write(srv)
-	res.Body.Close()
+	ph.serveH1(srv, ph.connHandler("https", addr))
+}
+
+// sniAddr 目标是 IP 时 (socks5 的 ATYP 1/4) 用客户端的 SNI 作为上游的 host,
+// 否则上游收不到 SNI, 证书也校验不过
+func sniAddr(addr, serverName string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || serverName == "" || net.ParseIP(host) == nil {
+		return addr
+	}
+	return net.JoinHostPort(serverName, port)
+}
+
+// serveH1 用 http.Server 处理一个 http1.1 连接
+func (ph *ProxyHandler) serveH1(conn net.Conn, handler http.Handler) {
+	ln := newConnListener(conn)
+	hs := &http.Server{
+		Handler:     handler,
+		ErrorLog:    logger,
+		IdleTimeout: idleTimeout,
+		ConnState:   ln.connState,
+		// h2 已经在上面处理了
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	}
+	ph.connMu.Lock()
+	if ph.servers == nil {
+		ph.servers = make(map[*http.Server]struct{})
+	}
+	ph.servers[hs] = struct{}{}
+	ph.connMu.Unlock()
+	defer func() {
+		ph.connMu.Lock()
+		delete(ph.servers, hs)
+		ph.connMu.Unlock()
+	}()
+	if ph.shuttingDown() {
+		// 处理完这个请求就关闭连接
+		hs.SetKeepAlivesEnabled(false)
+	}
+	hs.Serve(ln)
+}
+
+func (ph *ProxyHandler) h2(addr string, srv *tls.Conn) {
+	var conn net.Conn = srv
+	if ph.H2View != nil {
+		conn = ph.H2View.wrap(addr, srv)
+	}
+	defer conn.Close()
+	ph.h2s.ServeConn(conn, &http2.ServeConnOpts{
+		Handler:    ph.connHandler("https", addr),
+		BaseConfig: ph.h2base,
+	})
+}
+
+func (ph *ProxyHandler) trackConn(c io.Closer, add bool) {
+	ph.connMu.Lock()
+	defer ph.connMu.Unlock()
+	if ph.conns == nil {
+		ph.conns = make(map[io.Closer]struct{})
+	}
+	if add {
+		ph.conns[c] = struct{}{}
+	} else {
+		delete(ph.conns, c)
+	}
+}
+
+// upgradedConn 是 101 之后的上游连接, ReverseProxy 转发结束时 Close
+type upgradedConn struct {
+	io.ReadWriteCloser
+	ph   *ProxyHandler
+	once sync.Once
+}
+
+func newUpgradedConn(ph *ProxyHandler, rwc io.ReadWriteCloser) *upgradedConn {
+	c := &upgradedConn{ReadWriteCloser: rwc, ph: ph}
+	ph.trackConn(c, true)
+	return c
+}
+
+func (c *upgradedConn) Close() error {
+	c.once.Do(func() { c.ph.trackConn(c, false) })
+	return c.ReadWriteCloser.Close()
+}
+
+func (ph *ProxyHandler) shuttingDown() bool {
+	return atomic.LoadInt32(&ph.inShutdown) != 0
+}
+
+// Shutdown drains the hijacked connections, http.Server.Shutdown 不会等待这些连接:
+// 参与握手的连接处理完当前的请求之后关闭, h2 发送 GOAWAY, tunnel 和升级的连接等待结束,
+// ctx 结束时强制关闭剩下的连接
+func (ph *ProxyHandler) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&ph.inShutdown, 1)
+	ph.connMu.Lock()
+	servers := make([]*http.Server, 0, len(ph.servers))
+	for hs := range ph.servers {
+		servers = append(servers, hs)
+	}
+	ph.connMu.Unlock()
+	for _, hs := range servers {
+		// 关闭空闲的 keep-alive 连接, 正在处理的请求结束之后关闭
+		go hs.Shutdown(ctx)
+	}
+	if ph.h2base != nil {
+		go ph.h2base.Shutdown(ctx)
+	}
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
+	for {
+		ph.connMu.Lock()
+		n := len(ph.conns)
+		ph.connMu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			// upgradedConn.Close 也会加锁, 不能在持有 connMu 时关闭
+			ph.connMu.Lock()
+			conns := ph.conns
+			ph.conns = nil
+			ph.connMu.Unlock()
+			for c := range conns {
+				c.Close()
+			}
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// connHandler 处理连接到 addr 的请求, 请求里只有 path
+func (ph *ProxyHandler) connHandler(scheme, addr string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.URL.Host = addr
+		req.URL.Scheme = scheme
+		ph.serve(rw, req)
+	})
+}
+
+// connListener 把一个连接包装成 net.Listener 给 http.Server 使用,
+// 连接关闭之后 Accept 返回错误, Serve 随之退出
+type connListener struct {
+	mu   sync.Mutex
+	conn net.Conn
+	addr net.Addr
+	once sync.Once
+	done chan struct{}
+}
+
+func newConnListener(c net.Conn) *connListener {
+	return &connListener{
+		conn: c,
+		addr: c.LocalAddr(),
+		done: make(chan struct{}),
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	c := l.conn
+	l.conn = nil
+	l.mu.Unlock()
+	if c != nil {
+		return c, nil
+	}
+	<-l.done
+	return nil, errServerClosed
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *connListener) connState(c net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		l.Close()
+	}
 }
 
 func httpError(w io.WriteCloser, err error) {
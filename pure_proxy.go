@@ -1,10 +1,14 @@
 package gproxy
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,15 +17,32 @@ import (
 const maxHeaderBytes = 1 << 20
 
 var (
-	errNeedMore     = errors.New("need more data: cannot find trailing lf")
-	errLargeHeaders = errors.New("Request Header Fields Too Large")
+	errLargeHeaders  = errors.New("Request Header Fields Too Large")
+	errBackendClosed = errors.New("backend closed the connection")
 )
 
 var (
-	headerHost    = []byte("Host")
-	methodConnect = []byte("CONNECT")
-	pathRoot      = []byte("/")
-	http200       = []byte("HTTP/1.1 200 OK\r\n\r\n")
+	headerHost             = []byte("Host")
+	headerContentLength    = []byte("Content-Length")
+	headerTransferEncoding = []byte("Transfer-Encoding")
+	headerConnection       = []byte("Connection")
+	headerProxyConnection  = []byte("Proxy-Connection")
+	headerProxyAuth        = []byte("Proxy-Authorization")
+	headerKeepAlive        = []byte("Keep-Alive")
+	headerTE               = []byte("TE")
+	headerUpgrade          = []byte("Upgrade")
+	tokenChunked           = []byte("chunked")
+	tokenClose             = []byte("close")
+	tokenKeepAlive         = []byte("keep-alive")
+	tokenUpgrade           = []byte("upgrade")
+	methodConnect          = []byte("CONNECT")
+	methodHead             = []byte("HEAD")
+	methodOptions          = []byte("OPTIONS")
+	proto10                = []byte("HTTP/1.0")
+	schemeSep              = []byte("://")
+	asterisk               = []byte("*")
+	crlf                   = []byte("\r\n")
+	http200                = []byte("HTTP/1.1 200 OK\r\n\r\n")
 )
 
 // PureProxy is a tcp proxy handler http requests
@@ -33,6 +54,10 @@ type PureProxy struct {
 	doneChan    chan struct{}
 	listener    *net.Listener
 	ReadTimeout time.Duration
+	// 模拟 2G/3G/4G 等网络, nil 不使用
+	Profile *NetworkProfile
+	// 按 host 和客户端共享的限速
+	Limits []*LimitRule
 }
 
 type tcpKeepAliveListener struct {
@@ -88,16 +113,56 @@ func (p *PureProxy) Close() (err error) {
 	atomic.StoreInt32(&p.inShutdown, 1)
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	err = p.closeListenerLocked()
+	for c := range p.activeConn {
+		c.raw.Close()
+		delete(p.activeConn, c)
+	}
+	return
+}
+
+// Shutdown stops accepting connections, closes idle connections and waits for
+// active ones until ctx is done, 然后强制关闭剩下的连接
+func (p *PureProxy) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&p.inShutdown, 1)
+	p.mu.Lock()
+	lnerr := p.closeListenerLocked()
+	p.mu.Unlock()
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
+	for {
+		if p.closeIdleConns() {
+			return lnerr
+		}
+		select {
+		case <-ctx.Done():
+			p.Close()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func (p *PureProxy) closeListenerLocked() (err error) {
 	p.closeDoneChanLocked()
 	if p.listener != nil {
 		err = (*p.listener).Close()
 		p.listener = nil
 	}
+	return
+}
+
+// closeIdleConns 关闭没有正在处理请求的连接, 返回是否所有连接都已经关闭
+func (p *PureProxy) closeIdleConns() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	for c := range p.activeConn {
-		c.rwc.Close()
-		delete(p.activeConn, c)
+		if atomic.LoadInt32(&c.state) == 0 {
+			c.raw.Close()
+			delete(p.activeConn, c)
+		}
 	}
-	return
+	return len(p.activeConn) == 0
 }
 
 func (p *PureProxy) closeDoneChanLocked() {
@@ -123,6 +188,9 @@ func (p *PureProxy) getDoneChanLocked() chan struct{} {
 }
 
 func (p *PureProxy) serve(l net.Listener) error {
+	if p.Profile != nil {
+		l = p.Profile.Listener(l)
+	}
 	l = &onceCloseListener{Listener: l}
 	defer l.Close()
 	p.listener = &l
@@ -154,6 +222,7 @@ func (p *PureProxy) serve(l net.Listener) error {
 		c := &conn{
 			server: p,
 			rwc:    rw,
+			raw:    rw,
 		}
 		p.trackConn(c, true)
 		go c.serve()
@@ -183,154 +252,647 @@ type conn struct {
 	rwc                      net.Conn
 	host, method, requestURI []byte
 	isTLS                    bool
+	// rwc 可能被替换成限速的连接, Close 和 Shutdown 使用 raw
+	raw net.Conn
+	// 正在处理的请求数, 0 表示空闲
+	state int32
+	req   message
+	// 改写之后发给 backend 的请求头
+	out []byte
+}
+
+// 每个 backend 最多 pipelining 的请求数
+const maxPipeline = 32
+
+// backend 是当前 host 的连接, 响应由单独的 goroutine 转发
+type backend struct {
+	host    string
+	conn    net.Conn
+	pending chan pending
+	done    chan struct{}
+	// done 关闭之后才能读
+	err error
+}
+
+// pending 是已经发给 backend 还没有响应的请求
+type pending struct {
+	head bool
+	// Connection: upgrade 的请求, 收到响应之后告诉请求端是不是 101
+	upgraded chan bool
+}
+
+// finish 等待已经发出的请求都响应完, 之后不能再发请求
+func (b *backend) finish() error {
+	close(b.pending)
+	<-b.done
+	return b.err
 }
 
 func (c *conn) serve() {
 	buf := defaultBufferPool.Get()
+	br := newBufioReader(c.rwc)
+	var b *backend
 	defer func() {
+		if b != nil {
+			b.conn.Close()
+		}
 		c.close()
 		c.server.trackConn(c, false)
+		putBufioReader(br)
 		defaultBufferPool.Put(buf)
 	}()
-	cache, err := c.handleHost()
-	if err != nil {
-		httpError(c.rwc, err)
-		return
+	for {
+		// 收到请求的第一个字节之后才算活跃, Shutdown 会关闭空闲的连接
+		if _, err := br.Peek(1); err != nil {
+			if b != nil {
+				b.finish()
+			}
+			return
+		}
+		atomic.AddInt32(&c.state, 1)
+		closing, err := c.readRequest(br)
+		if err != nil {
+			if b != nil {
+				b.finish()
+			}
+			if _, ok := err.(net.Error); !ok && err != io.EOF {
+				requestError(c.rwc, err)
+			}
+			return
+		}
+		logger.Printf("%s %s %s", c.method, c.host, c.requestURI)
+		if b != nil && (c.isTLS || b.host != string(c.host)) {
+			// 换了 host, 等前一个 backend 的响应都转发完再切换
+			if err := b.finish(); err != nil {
+				return
+			}
+			b.conn.Close()
+			b = nil
+		}
+		if b == nil {
+			if b, err = c.dial(); err != nil {
+				httpError(c.rwc, err)
+				return
+			}
+			if !c.isTLS {
+				go c.forwardResponses(b)
+			}
+		}
+		if c.isTLS {
+			c.rwc.Write(http200)
+			// 客户端可能没等 200 就发了数据
+			if n := br.Buffered(); n > 0 {
+				p, _ := br.Peek(n)
+				if _, err := b.conn.Write(p); err != nil {
+					return
+				}
+			}
+			if err := tunnel(c.rwc, b.conn, buf); err != nil {
+				httpError(c.rwc, err)
+			}
+			return
+		}
+		p := pending{head: bytes.Equal(c.method, methodHead)}
+		if c.req.upgrade {
+			p.upgraded = make(chan bool, 1)
+		}
+		select {
+		case b.pending <- p:
+		case <-b.done:
+			return
+		}
+		if err := c.forwardRequest(b, br, buf); err != nil {
+			return
+		}
+		if p.upgraded != nil {
+			select {
+			case ok := <-p.upgraded:
+				if ok {
+					// 101 之后不再是 http, 直接转发
+					io.CopyBuffer(b.conn, br, buf)
+					return
+				}
+			case <-b.done:
+				return
+			}
+		}
+		if closing {
+			b.finish()
+			return
+		}
+	}
+}
+
+// readRequest 读取请求头, 返回请求之后是否要关闭连接
+func (c *conn) readRequest(br *bufio.Reader) (bool, error) {
+	if d := c.server.ReadTimeout; d != 0 {
+		c.rwc.SetReadDeadline(time.Now().Add(d))
+		defer c.rwc.SetReadDeadline(time.Time{})
+	}
+	if err := c.req.read(br); err != nil {
+		return false, err
 	}
-	logger.Printf("%s %s %s", c.method, c.host, c.requestURI)
-	backend, err := dialer.Dial("tcp", string(c.host))
+	method, requestURI, proto, err := readFirstLine(c.req.first)
 	if err != nil {
-		httpError(c.rwc, err)
-		return
+		return false, err
+	}
+	if c.req.transferEncoding {
+		// chunked 不是最后一个编码, 或者同时有 Content-Length, backend 对 body 长度的理解可能不一样
+		if !c.req.chunkedLast || c.req.contentLength >= 0 {
+			return false, &badStringError{"invalid Transfer-Encoding", string(c.req.first)}
+		}
 	}
+	c.method, c.requestURI = method, requestURI
+	c.isTLS = bytes.Equal(method, methodConnect)
+	http10 := bytes.Equal(proto, proto10)
+	var host []byte
 	if c.isTLS {
-		readToend(c.rwc)
-		c.rwc.Write(http200)
+		host = requestURI
 	} else {
-		backend.Write(cache)
+		// absolute-URI 时忽略 Host header, RFC 7230 5.4
+		host = uriHost(requestURI)
+		c.rewriteRequest(method, requestURI, proto, host, http10)
+		if host == nil {
+			host = c.req.host
+		}
+	}
+	if len(host) == 0 {
+		return false, &badStringError{"missing Host", string(c.req.first)}
+	}
+	if _, _, err := net.SplitHostPort(string(host)); err != nil {
+		host = append(append([]byte{}, host...), ":80"...)
+	}
+	c.host = host
+	return c.req.close || http10 && !c.req.keepAlive, nil
+}
+
+// rewriteRequest 把请求行改成 origin-form, 去掉 hop-by-hop 和只给代理的 header,
+// 结果放在 c.out, body 不受影响
+func (c *conn) rewriteRequest(method, requestURI, proto, host []byte, http10 bool) {
+	out := append(c.out[:0], method...)
+	out = append(out, ' ')
+	out = append(out, originForm(method, requestURI)...)
+	out = append(out, ' ')
+	out = append(out, proto...)
+	out = append(out, crlf...)
+	if host != nil {
+		out = append(out, headerHost...)
+		out = append(out, ": "...)
+		out = append(out, host...)
+		out = append(out, crlf...)
+	}
+	_, n := nextLine(c.req.head)
+	for b := c.req.head[n:]; len(b) > 0; b = b[n:] {
+		var line []byte
+		if line, n = nextLine(b); n == 0 || len(line) == 0 {
+			break
+		}
+		if i := bytes.IndexByte(line, ':'); i > 0 && c.hopByHop(line[:i], host != nil) {
+			continue
+		}
+		out = append(out, b[:n]...)
+	}
+	// Connection 只保留 backend 需要知道的
+	var tokens [][]byte
+	if c.req.upgrade {
+		tokens = append(tokens, headerUpgrade)
+	}
+	if c.req.close {
+		tokens = append(tokens, tokenClose)
+	} else if http10 && c.req.keepAlive {
+		tokens = append(tokens, tokenKeepAlive)
+	}
+	if len(tokens) > 0 {
+		out = append(out, headerConnection...)
+		out = append(out, ": "...)
+		out = append(out, bytes.Join(tokens, []byte(", "))...)
+		out = append(out, crlf...)
+	}
+	c.out = append(out, crlf...)
+}
+
+// hopByHop 判断请求头是不是只到代理为止, Upgrade 和决定 body 长度的 header 保留
+func (c *conn) hopByHop(name []byte, absolute bool) bool {
+	switch {
+	case caseInsensitiveCompare(name, headerHost):
+		return absolute
+	case caseInsensitiveCompare(name, headerUpgrade),
+		caseInsensitiveCompare(name, headerContentLength),
+		caseInsensitiveCompare(name, headerTransferEncoding):
+		return false
+	case caseInsensitiveCompare(name, headerConnection),
+		caseInsensitiveCompare(name, headerProxyConnection),
+		caseInsensitiveCompare(name, headerProxyAuth),
+		caseInsensitiveCompare(name, headerKeepAlive),
+		caseInsensitiveCompare(name, headerTE):
+		return true
+	}
+	for _, v := range c.req.connection {
+		if hasToken(v, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardRequest 转发请求头和 body
+func (c *conn) forwardRequest(b *backend, br *bufio.Reader, buf []byte) error {
+	if _, err := b.conn.Write(c.out); err != nil {
+		return err
+	}
+	switch {
+	case c.req.chunked:
+		return copyChunked(b.conn, br, c.rwc, buf)
+	case c.req.contentLength > 0:
+		return copyN(b.conn, br, c.rwc, c.req.contentLength, buf)
+	}
+	return nil
+}
+
+func (c *conn) dial() (*backend, error) {
+	bc, err := dialer.Dial("tcp", string(c.host))
+	if err != nil {
+		return nil, err
+	}
+	if limits := c.server.Limits; len(limits) > 0 {
+		host, _, _ := net.SplitHostPort(string(c.host))
+		down, up := matchLimits(limits, host, clientIP(c.rwc.RemoteAddr().String()))
+		// 从 backend 读是下载
+		bc = newLimitedConn(bc, up, down)
+	}
+	return &backend{
+		host:    string(c.host),
+		conn:    bc,
+		pending: make(chan pending, maxPipeline),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// forwardResponses 按请求的顺序转发 backend 的响应, 直到 b.pending 关闭
+func (c *conn) forwardResponses(b *backend) {
+	buf := defaultBufferPool.Get()
+	br := newBufioReader(b.conn)
+	defer func() {
+		putBufioReader(br)
+		defaultBufferPool.Put(buf)
+		close(b.done)
+	}()
+	var res message
+	for p := range b.pending {
+		if err := c.forwardResponse(b, br, &res, p, buf); err != nil {
+			b.err = err
+			// backend 不能再用了, 客户端的连接也一起关闭
+			c.rwc.Close()
+			return
+		}
+	}
+}
+
+func (c *conn) forwardResponse(b *backend, br *bufio.Reader, res *message, p pending, buf []byte) error {
+	var code int
+	var http10 bool
+	for {
+		if err := res.read(br); err != nil {
+			return err
+		}
+		var err error
+		if code, http10, err = readStatusLine(res.first); err != nil {
+			return err
+		}
+		if _, err := c.rwc.Write(res.head); err != nil {
+			return err
+		}
+		if code == 101 {
+			if p.upgraded != nil {
+				p.upgraded <- true
+			}
+			io.CopyBuffer(c.rwc, br, buf)
+			return errBackendClosed
+		}
+		// 1xx 之后还有最终的响应
+		if code >= 200 {
+			break
+		}
+	}
+	if p.upgraded != nil {
+		p.upgraded <- false
+	}
+	var err error
+	switch {
+	case p.head || code == 204 || code == 304:
+	case res.chunkedLast:
+		err = copyChunked(c.rwc, br, b.conn, buf)
+	case res.contentLength >= 0 && !res.transferEncoding:
+		err = copyN(c.rwc, br, b.conn, res.contentLength, buf)
+	default:
+		// 没有长度或者最后的编码不是 chunked, 读到 backend 关闭为止, RFC 7230 3.3.3
+		io.CopyBuffer(c.rwc, br, buf)
+		return errBackendClosed
 	}
-	cache = nil
-	err = tunnel(c.rwc, backend, buf)
 	if err != nil {
-		httpError(c.rwc, err)
+		return err
 	}
+	atomic.AddInt32(&c.state, -1)
+	if res.close || http10 && !res.keepAlive {
+		return errBackendClosed
+	}
+	return nil
+}
+
+// requestError 响应解析失败的请求, 之后关闭连接
+func requestError(w io.Writer, err error) {
+	logger.Println("bad request:", err)
+	status := "400 Bad Request"
+	if err == errLargeHeaders {
+		status = "431 Request Header Fields Too Large"
+	}
+	io.WriteString(w, "HTTP/1.1 "+status+"\r\nConnection: close\r\n\r\n")
 }
 
 func (c *conn) close() {
 	c.rwc.Close()
 }
 
-// @TODO 好像意义不大了, 先暂时这样吧
-func readToend(c net.Conn) error {
-	br := newBufioReader(c)
-	defer putBufioReader(br)
+// message 是请求或者响应的 header, 只解析转发需要的字段
+type message struct {
+	// 包括最后的空行
+	head  []byte
+	first []byte
+	host  []byte
+	// -1 表示没有 Content-Length
+	contentLength int64
+	// 多个 Transfer-Encoding 按顺序合并: chunked 是出现过 chunked,
+	// chunkedLast 是最后一个编码是 chunked, 只有这时才能按 chunked 找到 body 的结尾
+	transferEncoding bool
+	chunked          bool
+	chunkedLast      bool
+	close            bool
+	keepAlive        bool
+	upgrade          bool
+	// Connection header 的值, 里面列出的 header 也是 hop-by-hop
+	connection [][]byte
+}
+
+// read 读取到空行为止, 复用 m.head
+func (m *message) read(br *bufio.Reader) error {
+	head := m.head[:0]
+	start := 0
 	for {
 		line, err := br.ReadSlice('\n')
+		if len(head)+len(line) > maxHeaderBytes {
+			return errLargeHeaders
+		}
+		head = append(head, line...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
 		if err != nil {
+			if err == io.EOF && len(head) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
 			return err
 		}
-		if isEndLine(line) {
-			return nil
+		if isEndLine(head[start:]) {
+			// 请求之前的空行忽略, RFC 7230 3.5
+			if start == 0 {
+				head = head[:0]
+				continue
+			}
+			break
 		}
+		start = len(head)
 	}
+	m.head = head
+	return m.parse()
 }
 
-func isEndLine(line []byte) bool {
-	return len(line) == 2 && line[0] == '\r' && line[1] == '\n'
+func (m *message) parse() error {
+	m.host = nil
+	m.contentLength = -1
+	m.transferEncoding, m.chunked, m.chunkedLast = false, false, false
+	m.close, m.keepAlive, m.upgrade = false, false, false
+	m.connection = m.connection[:0]
+	line, n := nextLine(m.head)
+	m.first = line
+	for b := m.head[n:]; len(b) > 0; b = b[n:] {
+		if line, n = nextLine(b); n == 0 {
+			break
+		}
+		i := bytes.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		name, value := line[:i], trim(line[i+1:])
+		switch {
+		case caseInsensitiveCompare(name, headerHost):
+			m.host = value
+		case caseInsensitiveCompare(name, headerContentLength):
+			cl, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil || cl < 0 || m.contentLength >= 0 && m.contentLength != cl {
+				return &badStringError{"invalid Content-Length", string(value)}
+			}
+			m.contentLength = cl
+		case caseInsensitiveCompare(name, headerTransferEncoding):
+			m.transferEncoding = true
+			m.chunked = m.chunked || hasToken(value, tokenChunked)
+			m.chunkedLast = caseInsensitiveCompare(lastToken(value), tokenChunked)
+		case caseInsensitiveCompare(name, headerConnection):
+			m.connection = append(m.connection, value)
+			m.close = m.close || hasToken(value, tokenClose)
+			m.keepAlive = m.keepAlive || hasToken(value, tokenKeepAlive)
+			m.upgrade = m.upgrade || hasToken(value, tokenUpgrade)
+		}
+	}
+	return nil
 }
 
-// Host: example.com / Method
-// 读取 Header 的 Host 和 Method 字段
-func (c *conn) handleHost() ([]byte, error) {
-	if d := c.server.ReadTimeout; d != 0 {
-		deadline := time.Now().Add(d)
-		c.rwc.SetReadDeadline(deadline)
-	}
-	// http1.1
-	return c.readHostmetaH1()
-}
-
-// 需要读取 Method 和 Host, 并且返回已经读取到的 bytes
-func (c *conn) readHostmetaH1() ([]byte, error) {
-	// 一般情况下 Host 就是第二个header
-	arean := make([]byte, 32, 96)
-	// 已经读取到的bytes
-	cache := arean[32:]
-	buf := arean[0:32]
-	var next, total int
-	var line []byte
+// hasToken 判断逗号分隔的 header 值里有没有 token, 不区分大小写
+func hasToken(value, token []byte) bool {
+	for len(value) > 0 {
+		var v []byte
+		if i := bytes.IndexByte(value, ','); i >= 0 {
+			v, value = value[:i], value[i+1:]
+		} else {
+			v, value = value, nil
+		}
+		if caseInsensitiveCompare(trim(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// lastToken 返回逗号分隔的 header 值里最后一个 token
+func lastToken(value []byte) []byte {
+	if i := bytes.LastIndexByte(value, ','); i >= 0 {
+		value = value[i+1:]
+	}
+	return trim(value)
+}
+
+// copyN 先转发 bufio 里已经读到的, 剩下的直接从 src 读, 两端都是 TCPConn 时可以 splice
+func copyN(dst io.Writer, br *bufio.Reader, src io.Reader, n int64, buf []byte) error {
+	if b := int64(br.Buffered()); b > 0 {
+		if b > n {
+			b = n
+		}
+		p, _ := br.Peek(int(b))
+		if _, err := dst.Write(p); err != nil {
+			return err
+		}
+		br.Discard(int(b))
+		n -= b
+	}
+	if n == 0 {
+		return nil
+	}
+	written, err := io.CopyBuffer(dst, io.LimitReader(src, n), buf)
+	if err == nil && written < n {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// copyChunked 原样转发 chunked body 和 trailer
+func copyChunked(dst io.Writer, br *bufio.Reader, src io.Reader, buf []byte) error {
 	for {
-		if c.host != nil {
-			return cache[:total], nil
+		line, err := br.ReadSlice('\n')
+		if err != nil {
+			return err
 		}
-		// header 太大却啥也读不到,直接响应错误
-		if total > maxHeaderBytes {
-			return nil, errLargeHeaders
+		size, err := parseChunkSize(line)
+		if err != nil {
+			return err
 		}
-		n, err := c.rwc.Read(buf)
-		if n == 0 {
-			return cache[:total], err
+		if _, err := dst.Write(line); err != nil {
+			return err
 		}
-		cache = append(cache, buf[0:n]...)
-		total += n
-		if line, next = nextLine(cache[next:]); next == 0 {
-			continue
+		if size == 0 {
+			break
+		}
+		// 数据和结尾的 CRLF
+		if err := copyN(dst, br, src, size+2, buf); err != nil {
+			return err
+		}
+	}
+	for {
+		line, err := br.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(line); err != nil {
+			return err
 		}
 		if isEndLine(line) {
-			return cache[:total], nil
-		}
-		// 读取请求第一行信息,GET / HTTP/1.1
-		if c.method == nil {
-			method, requestURI, err := readFirstLine(line)
-			if err != nil {
-				if err == errNeedMore {
-					continue
-				}
-			}
-			c.method = method
-			c.isTLS = bytes.Equal(method, methodConnect)
-			if c.isTLS {
-				c.host = requestURI
-				c.requestURI = pathRoot
-			} else {
-				c.requestURI = requestURI
-			}
-		} else {
-			// @TODO 读完headers的处理
-			if host := tryReadHost(line); host != nil {
-				c.host = host
-			}
-			return cache[:total], nil
+			return nil
 		}
 	}
 }
 
-func readFirstLine(b []byte) (method, requestURI []byte, err error) {
-	n := bytes.IndexByte(b, ' ')
-	if n < 0 {
-		err = fmt.Errorf("cannot find whitespace in the first line of request")
-		return
+func parseChunkSize(line []byte) (int64, error) {
+	line, _ = nextLine(line)
+	if i := bytes.IndexByte(line, ';'); i >= 0 {
+		line = trim(line[:i])
+	}
+	size, err := strconv.ParseInt(string(line), 16, 64)
+	if err != nil || size < 0 {
+		return 0, &badStringError{"invalid chunk size", string(line)}
 	}
-	// parse method
-	n = bytes.IndexByte(b, ' ')
+	return size, nil
+}
+
+func isEndLine(line []byte) bool {
+	return len(line) == 2 && line[0] == '\r' && line[1] == '\n' ||
+		len(line) == 1 && line[0] == '\n'
+}
+
+// GET / HTTP/1.1
+func readFirstLine(b []byte) (method, requestURI, proto []byte, err error) {
+	n := bytes.IndexByte(b, ' ')
 	if n <= 0 {
-		err = fmt.Errorf("cannot find http request method")
+		err = &badStringError{"malformed HTTP request", string(b)}
 		return
 	}
 	method = b[:n]
 	b = b[n+1:]
-	// parse requestURI
 	n = bytes.LastIndexByte(b, ' ')
-	requestURI = b[:n]
+	if n <= 0 {
+		err = &badStringError{"malformed HTTP request", string(b)}
+		return
+	}
+	requestURI, proto = b[:n], b[n+1:]
 	return
 }
 
-func tryReadHost(buf []byte) []byte {
-	n := bytes.Index(buf, headerHost)
-	if n < 0 {
+// HTTP/1.1 200 OK
+func readStatusLine(b []byte) (code int, http10 bool, err error) {
+	n := bytes.IndexByte(b, ' ')
+	if n <= 0 || len(b) < n+4 {
+		err = &badStringError{"malformed HTTP response", string(b)}
+		return
+	}
+	http10 = bytes.Equal(b[:n], proto10)
+	if code, err = strconv.Atoi(string(b[n+1 : n+4])); err != nil || code < 100 {
+		err = &badStringError{"malformed HTTP status code", string(b[n+1:])}
+	}
+	return
+}
+
+// uriHost 返回 absolute-URI 里的 host, 不是 absolute-URI 返回 nil
+func uriHost(uri []byte) []byte {
+	n := schemeLen(uri)
+	if n == 0 {
 		return nil
 	}
-	return skipDelimiter(buf, n+len(headerHost))
+	host := uri[n+len(schemeSep):]
+	if i := bytes.IndexAny(host, "/?#"); i >= 0 {
+		host = host[:i]
+	}
+	if i := bytes.LastIndexByte(host, '@'); i >= 0 {
+		host = host[i+1:]
+	}
+	return host
+}
+
+// originForm 把 absolute-URI 改成 origin-form, http://host/path?q -> /path?q
+func originForm(method, uri []byte) []byte {
+	n := schemeLen(uri)
+	if n == 0 {
+		return uri
+	}
+	rest := uri[n+len(schemeSep):]
+	if i := bytes.IndexAny(rest, "/?#"); i >= 0 {
+		rest = rest[i:]
+	} else {
+		rest = nil
+	}
+	if i := bytes.IndexByte(rest, '#'); i >= 0 {
+		rest = rest[:i]
+	}
+	if len(rest) == 0 && bytes.Equal(method, methodOptions) {
+		return asterisk
+	}
+	if len(rest) == 0 || rest[0] != '/' {
+		return append([]byte{'/'}, rest...)
+	}
+	return rest
+}
+
+// schemeLen 返回 absolute-URI 的 scheme 长度, origin-form 里的 "://" 不算
+func schemeLen(uri []byte) int {
+	n := bytes.Index(uri, schemeSep)
+	if n <= 0 {
+		return 0
+	}
+	for i, ch := range uri[:n] {
+		switch {
+		case 'a' <= ch|0x20 && ch|0x20 <= 'z':
+		case i > 0 && ('0' <= ch && ch <= '9' || ch == '+' || ch == '-' || ch == '.'):
+		default:
+			return 0
+		}
+	}
+	return n
 }
 
 func nextLine(b []byte) ([]byte, int) {
@@ -357,21 +919,6 @@ func trim(s []byte) []byte {
 	return s[i:n]
 }
 
-func skipDelimiter(buf []byte, n int) []byte {
-	if n >= len(buf) {
-		return nil
-	}
-	if buf[n] != ':' {
-		return nil
-	}
-	n++
-	if buf[n] != ' ' {
-		return nil
-	}
-	n++
-	return buf[n:]
-}
-
 func caseInsensitiveCompare(a, b []byte) bool {
 	if len(a) != len(b) {
 		return false
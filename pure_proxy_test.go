@@ -0,0 +1,488 @@
+package gproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Transfer-Encoding 有歧义的请求直接拒绝, 不能和 backend 对 body 的结尾理解不一样
+func TestPureProxyTransferEncoding(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		fmt.Fprintf(rw, "%s", body)
+	}))
+	defer backend.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &PureProxy{}
+	go p.serve(ln)
+	defer p.Close()
+
+	host := backend.Listener.Addr().String()
+	tests := []struct {
+		name   string
+		header string
+		body   string
+		status int
+		want   string
+	}{
+		{"chunked", "Transfer-Encoding: chunked\r\n", "3\r\nabc\r\n0\r\n\r\n", 200, "abc"},
+		{"chunked not last", "Transfer-Encoding: chunked\r\nTransfer-Encoding: gzip\r\n", "3\r\nabc\r\n0\r\n\r\n", 400, ""},
+		{"chunked not last in list", "Transfer-Encoding: chunked, gzip\r\n", "3\r\nabc\r\n0\r\n\r\n", 400, ""},
+		{"with content-length", "Transfer-Encoding: chunked\r\nContent-Length: 3\r\n", "3\r\nabc\r\n0\r\n\r\n", 400, ""},
+		{"content-length", "Content-Length: 3\r\n", "abc", 200, "abc"},
+	}
+	for _, tt := range tests {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(c, "POST http://%s/ HTTP/1.1\r\nHost: %s\r\n%s\r\n%s", host, host, tt.header, tt.body)
+		res, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		c.Close()
+		if res.StatusCode != tt.status || string(body) != tt.want {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, res.StatusCode, body, tt.status, tt.want)
+		}
+	}
+}
+
+// 同时使用 Profile 和 Limits 时 tunnel 两端都是包装过的连接, 两个方向同时传数据
+func TestPureProxyTunnelBidirectional(t *testing.T) {
+	const size = 8 << 20
+	up := make([]byte, size)
+	down := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(up)
+	rand.New(rand.NewSource(2)).Read(down)
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	errc := make(chan error, 4)
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer c.Close()
+		go func() {
+			_, err := c.Write(down)
+			errc <- err
+		}()
+		errc <- expectRead(c, up)
+	}()
+
+	limit := &LimitRule{Name: "all"}
+	if err := limit.compile(); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &PureProxy{Profile: &NetworkProfile{Name: "fast"}, Limits: []*LimitRule{limit}}
+	go p.serve(ln)
+	defer p.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(30 * time.Second))
+	addr := backend.Addr().String()
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	if err := expectRead(c, http200); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, err := c.Write(up)
+		errc <- err
+	}()
+	errc <- expectRead(c, down)
+	for i := 0; i < 4; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expectRead(r io.Reader, want []byte) error {
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("corrupted data, %d bytes", len(want))
+	}
+	return nil
+}
+
+// rawBackend 按 path 返回不同格式的响应, 记录建立的连接数
+type rawBackend struct {
+	name string
+	ln   net.Listener
+
+	mu    sync.Mutex
+	conns int
+}
+
+func newRawBackend(t *testing.T, name string) *rawBackend {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &rawBackend{name: name, ln: ln}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.conns++
+			b.mu.Unlock()
+			go b.serve(c)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return b
+}
+
+func (b *rawBackend) connCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conns
+}
+
+func (b *rawBackend) serve(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, req.Body)
+		body := b.name + req.URL.Path
+		switch req.URL.Path {
+		case "/1xx":
+			io.WriteString(c, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </a.css>\r\n\r\n")
+			fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		case "/204":
+			io.WriteString(c, "HTTP/1.1 204 No Content\r\n\r\n")
+		case "/304":
+			// 304 的 Content-Length 是完整响应的长度, 没有 body
+			io.WriteString(c, "HTTP/1.1 304 Not Modified\r\nContent-Length: 10\r\n\r\n")
+		case "/chunked":
+			fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n%x\r\n%s\r\n0\r\nX-Trailer: 1\r\n\r\n", len(body), body)
+		case "/close":
+			fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+			return
+		case "/eof":
+			// 没有长度, 读到连接关闭为止
+			fmt.Fprintf(c, "HTTP/1.1 200 OK\r\n\r\n%s", body)
+			return
+		case "/upgrade":
+			io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+			io.Copy(c, br)
+			return
+		default:
+			fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n", len(body))
+			if req.Method != "HEAD" {
+				io.WriteString(c, body)
+			}
+		}
+	}
+}
+
+// rawRequest 是发给代理的 absolute-URI 请求, host 是 {A} 或者 {B}
+func rawRequest(method, host, path string, header ...string) string {
+	return fmt.Sprintf("%s http://%s%s HTTP/1.1\r\nHost: %s\r\n%s\r\n", method, host, path, host, strings.Join(header, ""))
+}
+
+func TestPureProxyConnections(t *testing.T) {
+	upgrade := "Connection: Upgrade\r\nUpgrade: echo\r\n"
+	tests := []struct {
+		name string
+		reqs []string
+		// 所有请求一起发送, 否则收到响应之后再发下一个
+		pipeline bool
+		// 每个请求的响应, "状态码 body", 1xx 在最终的响应之前
+		want [][]string
+		// 每个 backend 建立的连接数
+		conns [2]int
+		// 响应之后代理关闭连接
+		closed bool
+		// 升级之后原样返回
+		echo bool
+	}{
+		{
+			name:  "keep-alive",
+			reqs:  []string{rawRequest("GET", "{A}", "/1"), rawRequest("GET", "{A}", "/2"), rawRequest("POST", "{A}", "/3", "Content-Length: 3\r\n") + "abc"},
+			want:  [][]string{{"200 A/1"}, {"200 A/2"}, {"200 A/3"}},
+			conns: [2]int{1, 0},
+		},
+		{
+			name:  "switch backend",
+			reqs:  []string{rawRequest("GET", "{A}", "/1"), rawRequest("GET", "{B}", "/2"), rawRequest("GET", "{B}", "/3")},
+			want:  [][]string{{"200 A/1"}, {"200 B/2"}, {"200 B/3"}},
+			conns: [2]int{1, 1},
+		},
+		{
+			name:     "pipelining",
+			reqs:     []string{rawRequest("GET", "{A}", "/1"), rawRequest("GET", "{A}", "/2"), rawRequest("GET", "{B}", "/3"), rawRequest("GET", "{A}", "/4")},
+			pipeline: true,
+			want:     [][]string{{"200 A/1"}, {"200 A/2"}, {"200 B/3"}, {"200 A/4"}},
+			conns:    [2]int{2, 1},
+		},
+		{
+			name:     "1xx",
+			reqs:     []string{rawRequest("GET", "{A}", "/1xx"), rawRequest("GET", "{A}", "/2")},
+			pipeline: true,
+			want:     [][]string{{"100 ", "103 ", "200 A/1xx"}, {"200 A/2"}},
+			conns:    [2]int{1, 0},
+		},
+		{
+			name:     "no body",
+			reqs:     []string{rawRequest("HEAD", "{A}", "/1"), rawRequest("GET", "{A}", "/204"), rawRequest("GET", "{A}", "/304"), rawRequest("GET", "{A}", "/4")},
+			pipeline: true,
+			want:     [][]string{{"200 "}, {"204 "}, {"304 "}, {"200 A/4"}},
+			conns:    [2]int{1, 0},
+		},
+		{
+			name:     "chunked",
+			reqs:     []string{rawRequest("GET", "{A}", "/chunked"), rawRequest("GET", "{A}", "/2")},
+			pipeline: true,
+			want:     [][]string{{"200 A/chunked"}, {"200 A/2"}},
+			conns:    [2]int{1, 0},
+		},
+		{
+			name:  "101",
+			reqs:  []string{rawRequest("GET", "{A}", "/upgrade", upgrade)},
+			want:  [][]string{{"101 "}},
+			conns: [2]int{1, 0},
+			echo:  true,
+		},
+		{
+			name:  "upgrade refused",
+			reqs:  []string{rawRequest("GET", "{A}", "/1", upgrade), rawRequest("GET", "{A}", "/2")},
+			want:  [][]string{{"200 A/1"}, {"200 A/2"}},
+			conns: [2]int{1, 0},
+		},
+		{
+			name:   "client close",
+			reqs:   []string{rawRequest("GET", "{A}", "/1", "Connection: close\r\n")},
+			want:   [][]string{{"200 A/1"}},
+			conns:  [2]int{1, 0},
+			closed: true,
+		},
+		{
+			name:   "http/1.0",
+			reqs:   []string{"GET http://{A}/1 HTTP/1.0\r\n\r\n"},
+			want:   [][]string{{"200 A/1"}},
+			conns:  [2]int{1, 0},
+			closed: true,
+		},
+		{
+			name:   "backend close",
+			reqs:   []string{rawRequest("GET", "{A}", "/close")},
+			want:   [][]string{{"200 A/close"}},
+			conns:  [2]int{1, 0},
+			closed: true,
+		},
+		{
+			name:   "body until eof",
+			reqs:   []string{rawRequest("GET", "{A}", "/eof")},
+			want:   [][]string{{"200 A/eof"}},
+			conns:  [2]int{1, 0},
+			closed: true,
+		},
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &PureProxy{}
+	go p.serve(ln)
+	defer p.Close()
+
+	for _, tt := range tests {
+		a, b := newRawBackend(t, "A"), newRawBackend(t, "B")
+		r := strings.NewReplacer("{A}", a.ln.Addr().String(), "{B}", b.ln.Addr().String())
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(c)
+		if tt.pipeline {
+			var all string
+			for _, req := range tt.reqs {
+				all += req
+			}
+			io.WriteString(c, r.Replace(all))
+		}
+		for i, req := range tt.reqs {
+			if !tt.pipeline {
+				io.WriteString(c, r.Replace(req))
+			}
+			method := req[:strings.IndexByte(req, ' ')]
+			for _, want := range tt.want[i] {
+				res, err := http.ReadResponse(br, &http.Request{Method: method})
+				if err != nil {
+					t.Fatalf("%s: #%d %v", tt.name, i, err)
+				}
+				body, err := ioutil.ReadAll(res.Body)
+				if err != nil {
+					t.Fatalf("%s: #%d body %v", tt.name, i, err)
+				}
+				if got := fmt.Sprintf("%d %s", res.StatusCode, body); got != want {
+					t.Errorf("%s: #%d got %q, want %q", tt.name, i, got, want)
+				}
+			}
+		}
+		if tt.echo {
+			io.WriteString(c, "ping")
+			if err := expectRead(br, []byte("ping")); err != nil {
+				t.Errorf("%s: echo %v", tt.name, err)
+			}
+		}
+		if tt.closed {
+			if _, err := br.ReadByte(); err != io.EOF {
+				t.Errorf("%s: connection not closed: %v", tt.name, err)
+			}
+		}
+		c.Close()
+		if got := [2]int{a.connCount(), b.connCount()}; got != tt.conns {
+			t.Errorf("%s: backend conns %v, want %v", tt.name, got, tt.conns)
+		}
+	}
+}
+
+func TestPureProxyOriginForm(t *testing.T) {
+	tests := []struct {
+		method, uri string
+		want, host  string
+	}{
+		{"GET", "http://a.com/p?q=1", "/p?q=1", "a.com"},
+		{"GET", "http://a.com?q=1", "/?q=1", "a.com"},
+		{"GET", "http://a.com", "/", "a.com"},
+		{"GET", "http://a.com:8080/p#frag", "/p", "a.com:8080"},
+		{"GET", "http://a.com#frag", "/", "a.com"},
+		{"GET", "http://user:pw@a.com/p", "/p", "a.com"},
+		{"GET", "HTTPS://a.com/", "/", "a.com"},
+		{"OPTIONS", "http://a.com", "*", "a.com"},
+		{"OPTIONS", "http://a.com/", "/", "a.com"},
+		{"OPTIONS", "*", "*", ""},
+		{"GET", "/p", "/p", ""},
+		{"GET", "/redirect?to=http://b.com/", "/redirect?to=http://b.com/", ""},
+	}
+	for _, tt := range tests {
+		if got := string(originForm([]byte(tt.method), []byte(tt.uri))); got != tt.want {
+			t.Errorf("originForm(%s %s) = %q, want %q", tt.method, tt.uri, got, tt.want)
+		}
+		if got := string(uriHost([]byte(tt.uri))); got != tt.host {
+			t.Errorf("uriHost(%s) = %q, want %q", tt.uri, got, tt.host)
+		}
+	}
+}
+
+func TestPureProxyRewriteRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      string
+		want     string
+		wantHost string
+	}{
+		{
+			"absolute-URI replaces Host",
+			"GET http://a.com/p?q=1 HTTP/1.1\r\nHost: b.com\r\nAccept: */*\r\n\r\n",
+			"GET /p?q=1 HTTP/1.1\r\nHost: a.com\r\nAccept: */*\r\n\r\n",
+			"a.com:80",
+		},
+		{
+			"userinfo",
+			"GET http://u:p@a.com:8080 HTTP/1.1\r\nHost: b.com\r\n\r\n",
+			"GET / HTTP/1.1\r\nHost: a.com:8080\r\n\r\n",
+			"a.com:8080",
+		},
+		{
+			"origin-form keeps Host",
+			"GET /p HTTP/1.1\r\nHost: a.com\r\nProxy-Connection: keep-alive\r\n\r\n",
+			"GET /p HTTP/1.1\r\nHost: a.com\r\n\r\n",
+			"a.com:80",
+		},
+		{
+			"hop-by-hop",
+			"GET http://a.com/ HTTP/1.1\r\nHost: a.com\r\nProxy-Connection: keep-alive\r\nProxy-Authorization: Basic eDp5\r\n" +
+				"Keep-Alive: timeout=5\r\nTE: trailers\r\nConnection: X-Foo, keep-alive\r\nx-foo: 1\r\nX-Bar: 2\r\n\r\n",
+			"GET / HTTP/1.1\r\nHost: a.com\r\nX-Bar: 2\r\n\r\n",
+			"a.com:80",
+		},
+		{
+			"body headers listed in Connection",
+			"POST http://a.com/ HTTP/1.1\r\nConnection: Content-Length\r\nContent-Length: 3\r\n\r\n",
+			"POST / HTTP/1.1\r\nHost: a.com\r\nContent-Length: 3\r\n\r\n",
+			"a.com:80",
+		},
+		{
+			"upgrade",
+			"GET http://a.com/ws HTTP/1.1\r\nHost: a.com\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Key: k\r\n\r\n",
+			"GET /ws HTTP/1.1\r\nHost: a.com\r\nUpgrade: websocket\r\nSec-WebSocket-Key: k\r\nConnection: Upgrade\r\n\r\n",
+			"a.com:80",
+		},
+		{
+			"close",
+			"GET http://a.com/ HTTP/1.1\r\nConnection: close\r\n\r\n",
+			"GET / HTTP/1.1\r\nHost: a.com\r\nConnection: close\r\n\r\n",
+			"a.com:80",
+		},
+		{
+			"http/1.0 keep-alive",
+			"GET http://a.com/ HTTP/1.0\r\nConnection: Keep-Alive\r\nKeep-Alive: timeout=5\r\n\r\n",
+			"GET / HTTP/1.0\r\nHost: a.com\r\nConnection: keep-alive\r\n\r\n",
+			"a.com:80",
+		},
+		{
+			"options asterisk",
+			"OPTIONS http://a.com:8080 HTTP/1.1\r\n\r\n",
+			"OPTIONS * HTTP/1.1\r\nHost: a.com:8080\r\n\r\n",
+			"a.com:8080",
+		},
+	}
+	for _, tt := range tests {
+		c := &conn{server: &PureProxy{}}
+		if _, err := c.readRequest(bufio.NewReader(strings.NewReader(tt.req))); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(c.out) != tt.want {
+			t.Errorf("%s: got\n%q\nwant\n%q", tt.name, c.out, tt.want)
+		}
+		if string(c.host) != tt.wantHost {
+			t.Errorf("%s: host %q, want %q", tt.name, c.host, tt.wantHost)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package gproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	errFlowNotFound  = errors.New("flow not found")
+	errBodyTruncated = errors.New("flow request body is truncated")
+)
+
+// Replay re-sends captured flows through ProxyHandler.Transport
+type Replay struct {
+	IDs  []uint64  `json:"ids"`
+	Edit *FlowEdit `json:"edit,omitempty"`
+	// 并发数, 默认 1
+	Concurrency int `json:"concurrency"`
+	// 每个 flow 重放的次数, 默认 1
+	Repeat int `json:"repeat"`
+	// 同一个并发里两次请求的间隔
+	Delay Duration `json:"delay"`
+}
+
+// FlowEdit changes the request before replay, 零值的字段保持不变
+type FlowEdit struct {
+	Method       string            `json:"method,omitempty"`
+	URL          string            `json:"url,omitempty"`
+	SetHeader    map[string]string `json:"setHeader,omitempty"`
+	RemoveHeader []string          `json:"removeHeader,omitempty"`
+	Body         *string           `json:"body,omitempty"`
+}
+
+// Duration is a time.Duration in json, "1.5s" or nanoseconds
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(b, &n); err != nil {
+			return err
+		}
+		*d = Duration(n)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// 请求里的 hop-by-hop 和代理相关的 header 不需要重放
+var replaySkipHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Proxy-Authorization",
+	"Keep-Alive",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Replay re-sends flows and stores the responses as new flows linked to the originals
+func (ph *ProxyHandler) Replay(ctx context.Context, r *Replay) ([]*Flow, error) {
+	store := ph.Flows
+	if store == nil {
+		return nil, errNoFlows
+	}
+	repeat := r.Repeat
+	if repeat <= 0 {
+		repeat = 1
+	}
+	var origins []*Flow
+	for i := 0; i < repeat; i++ {
+		for _, id := range r.IDs {
+			f := store.Get(id)
+			if f == nil {
+				return nil, errFlowNotFound
+			}
+			if f.Request.BodySize > int64(len(f.Request.Body)) {
+				return nil, errBodyTruncated
+			}
+			origins = append(origins, f)
+		}
+	}
+	concurrency := r.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	results := make([]*Flow, len(origins))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			first := true
+			for n := range jobs {
+				if !first && r.Delay > 0 {
+					select {
+					case <-time.After(time.Duration(r.Delay)):
+					case <-ctx.Done():
+					}
+				}
+				first = false
+				results[n] = ph.replay(ctx, origins[n], r.Edit)
+			}
+		}()
+	}
+	for n := range origins {
+		select {
+		case jobs <- n:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	var flows []*Flow
+	for _, f := range results {
+		if f != nil {
+			flows = append(flows, f)
+		}
+	}
+	return flows, ctx.Err()
+}
+
+func (ph *ProxyHandler) replay(ctx context.Context, origin *Flow, edit *FlowEdit) *Flow {
+	if ctx.Err() != nil {
+		return nil
+	}
+	store := ph.Flows
+	req, err := newReplayRequest(ctx, origin.Request, edit)
+	if err != nil {
+		f := &Flow{
+			ID:       store.nextID(),
+			Request:  origin.Request,
+			Error:    err.Error(),
+			ReplayOf: origin.ID,
+		}
+		f.Timings.Start = time.Now()
+		f.Timings.End = f.Timings.Start
+		store.Add(f)
+		return f
+	}
+	c := newCapture(store.nextID(), req, store.maxBodySize())
+	c.flow.ReplayOf = origin.ID
+	req = c.wrap(req)
+	logger.Printf("replay %d %s %s", origin.ID, req.Method, req.URL)
+	var status int
+	var header http.Header
+	res, err := ph.Transport.RoundTrip(req)
+	if err != nil {
+		c.flow.Error = err.Error()
+	} else {
+		status, header = res.StatusCode, cloneHeader(res.Header)
+		buf := ph.BufferPool.Get()
+		_, err = io.CopyBuffer(&c.resBuf, res.Body, buf)
+		ph.BufferPool.Put(buf)
+		res.Body.Close()
+		if err != nil {
+			c.flow.Error = err.Error()
+		}
+	}
+	f := c.finish(status, header)
+	store.Add(f)
+	return f
+}
+
+func newReplayRequest(ctx context.Context, r *FlowRequest, edit *FlowEdit) (*http.Request, error) {
+	method, rawurl, body := r.Method, r.URL, r.Body
+	if edit != nil {
+		if edit.Method != "" {
+			method = edit.Method
+		}
+		if edit.URL != "" {
+			rawurl = edit.URL
+		}
+		if edit.Body != nil {
+			body = []byte(*edit.Body)
+		}
+	}
+	req, err := http.NewRequest(method, rawurl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header = cloneHeader(r.Header)
+	for _, k := range replaySkipHeaders {
+		req.Header.Del(k)
+	}
+	// 长度以实际的 body 为准
+	req.Header.Del("Content-Length")
+	if edit != nil {
+		for k, v := range edit.SetHeader {
+			req.Header.Set(k, v)
+		}
+		for _, k := range edit.RemoveHeader {
+			req.Header.Del(k)
+		}
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+	return req, nil
+}
@@ -0,0 +1,261 @@
+package gproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNoRoute   = errors.New("no route")
+	errNoBackend = errors.New("no healthy backend")
+)
+
+// ReverseConfig is the config of ReverseHandler
+//
+//	{
+//	  "pools": {
+//	    "api": {"backends": [{"url": "http://127.0.0.1:3000", "weight": 3}, {"url": "http://127.0.0.1:3001"}]},
+//	    "web": {"backends": [{"url": "http://127.0.0.1:8000"}]}
+//	  },
+//	  "routes": [
+//	    {"host": "api.local", "path": "/v1/", "pool": "api"},
+//	    {"path": "/", "pool": "web"}
+//	  ]
+//	}
+type ReverseConfig struct {
+	Pools  map[string]*PoolConfig `json:"pools"`
+	Routes []*Route               `json:"routes"`
+}
+
+// PoolConfig is a group of backends
+type PoolConfig struct {
+	Backends []*Backend `json:"backends"`
+	// 保留客户端请求的 Host header, 默认使用 backend 的 host
+	PreserveHost bool `json:"preserveHost,omitempty"`
+	// swrr(默认), leastconn, ring, maglev, p2c
+	Balancer string `json:"balancer,omitempty"`
+	// ring 和 maglev 的 key: ip, header:<name>, cookie:<name>; 请求里没有 key 时加权轮询
+	HashKey string `json:"hashKey,omitempty"`
+	// nil 不做健康检查
+	Health *HealthCheck `json:"health,omitempty"`
+}
+
+// Backend is an upstream server of a pool
+type Backend struct {
+	URL string `json:"url"`
+	// 默认 1
+	Weight int `json:"weight,omitempty"`
+}
+
+// Route chooses the pool by host and path prefix, 按顺序匹配第一个
+type Route struct {
+	// 支持 *.example.com 这样的通配, 空匹配所有
+	Host string `json:"host,omitempty"`
+	// path 前缀, 空匹配所有
+	Path string `json:"path,omitempty"`
+	Pool string `json:"pool"`
+
+	pool *Pool
+}
+
+// Pool picks a healthy backend by the balancer of the pool
+type Pool struct {
+	Name         string
+	PreserveHost bool
+	Health       *HealthCheck
+
+	mu       sync.Mutex
+	members  []*member
+	balancer balancer
+}
+
+// ReverseHandler forwards requests to pools of backends
+type ReverseHandler struct {
+	Pools  map[string]*Pool
+	Routes []*Route
+	// 默认是 httputil.ReverseProxy
+	Handler http.Handler
+
+	transport http.RoundTripper
+	done      chan struct{}
+	once      sync.Once
+}
+
+type reverseKey struct{}
+
+// LoadReverseConfig loads the config from a json file
+func LoadReverseConfig(file string) (*ReverseConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := new(ReverseConfig)
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return config, nil
+}
+
+// NewReverseHandler returns a ReverseHandler of config
+func NewReverseHandler(config *ReverseConfig) (*ReverseHandler, error) {
+	h := &ReverseHandler{
+		Pools:     make(map[string]*Pool, len(config.Pools)),
+		transport: defaultTransport(),
+		done:      make(chan struct{}),
+	}
+	for name, pc := range config.Pools {
+		p, err := newPool(name, pc)
+		if err != nil {
+			return nil, err
+		}
+		h.Pools[name] = p
+	}
+	for _, r := range config.Routes {
+		p, ok := h.Pools[r.Pool]
+		if !ok {
+			return nil, fmt.Errorf("route %s%s: unknown pool %q", r.Host, r.Path, r.Pool)
+		}
+		route := *r
+		route.pool = p
+		h.Routes = append(h.Routes, &route)
+	}
+	h.Handler = &httputil.ReverseProxy{
+		Director:       reverseDirector,
+		Transport:      h.transport,
+		BufferPool:     defaultBufferPool,
+		ErrorLog:       logger,
+		ModifyResponse: reverseResponse,
+		ErrorHandler:   reverseError,
+	}
+	for _, p := range h.Pools {
+		if p.Health != nil && p.Health.Type != "" {
+			go p.check(h.transport, h.done)
+		}
+	}
+	return h, nil
+}
+
+// Close stops the health checks
+func (h *ReverseHandler) Close() error {
+	h.once.Do(func() { close(h.done) })
+	return nil
+}
+
+func newPool(name string, pc *PoolConfig) (*Pool, error) {
+	if len(pc.Backends) == 0 {
+		return nil, fmt.Errorf("pool %s: no backends", name)
+	}
+	if err := pc.Health.init(); err != nil {
+		return nil, fmt.Errorf("pool %s: %s", name, err)
+	}
+	p := &Pool{
+		Name:         name,
+		PreserveHost: pc.PreserveHost,
+		Health:       pc.Health,
+	}
+	for i, b := range pc.Backends {
+		u, err := url.Parse(b.URL)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %s", name, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("pool %s: invalid backend %q", name, b.URL)
+		}
+		w := b.Weight
+		if w <= 0 {
+			w = 1
+		}
+		p.members = append(p.members, &member{
+			url:     u,
+			weight:  w,
+			node:    &node{ew: w, id: i},
+			healthy: true,
+		})
+	}
+	names := make([]string, len(p.members))
+	weights := make([]int, len(p.members))
+	for i, m := range p.members {
+		names[i] = m.url.String()
+		weights[i] = m.weight
+	}
+	b, err := newBalancer(pc.Balancer, pc.HashKey, names, weights)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %s", name, err)
+	}
+	p.balancer = b
+	return p, nil
+}
+
+func (r *Route) match(req *http.Request) bool {
+	if r.Host != "" {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !matchHost(r.Host, host) {
+			return false
+		}
+	}
+	return strings.HasPrefix(req.URL.Path, r.Path)
+}
+
+func (h *ReverseHandler) route(req *http.Request) *Route {
+	for _, r := range h.Routes {
+		if r.match(req) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (h *ReverseHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	r := h.route(req)
+	if r == nil {
+		logger.Printf("reverse %s %s%s %s", req.Method, req.Host, req.URL, errNoRoute)
+		http.Error(rw, "404 page not found", http.StatusNotFound)
+		return
+	}
+	m := r.pool.pick(req)
+	if m == nil {
+		logger.Printf("reverse %s %s%s pool %s %s", req.Method, req.Host, req.URL, r.pool.Name, errNoBackend)
+		http.Error(rw, "503 Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	logger.Printf("reverse %s %s%s -> %s", req.Method, req.Host, req.URL, m.url)
+	t := &reverseTarget{pool: r.pool, member: m, start: time.Now()}
+	defer r.pool.release(m)
+	h.Handler.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), reverseKey{}, t)))
+}
+
+type reverseTarget struct {
+	pool   *Pool
+	member *member
+	start  time.Time
+}
+
+func reverseDirector(req *http.Request) {
+	t, ok := req.Context().Value(reverseKey{}).(*reverseTarget)
+	if !ok {
+		return
+	}
+	u := t.member.url
+	req.URL.Scheme = u.Scheme
+	req.URL.Host = u.Host
+	if p := u.Path; p != "" && p != "/" {
+		req.URL.Path = strings.TrimSuffix(p, "/") + req.URL.Path
+		req.URL.RawPath = ""
+	}
+	if !t.pool.PreserveHost {
+		req.Host = ""
+	}
+}
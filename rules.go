@@ -0,0 +1,299 @@
+package gproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rules is the rule file of ProxyHandler
+//
+//	{
+//	  "rewrite": [{
+//	    "match": {"host": "*.example.com", "path": "^/api/", "method": "GET", "header": {"X-Env": "^dev$"}},
+//	    "request": {"setHeader": {"X-Debug": "1"}, "url": {"pattern": "/v1/", "with": "/v2/"}},
+//	    "response": {"status": 500, "replaceBody": [{"pattern": "foo", "with": "bar"}], "delay": "1s"}
+//	  }],
+//	  "mapLocal": [{
+//	    "match": {"host": "cdn.example.com", "path": "^/app\\..*\\.js$"},
+//	    "path": "./dist/app.js"
+//	  }],
+//	  "mapRemote": [{"from": "https://api.prod.example.com/v2/", "to": "http://localhost:3000/v2/"}],
+//	  "breakpoints": [{"match": {"host": "api.example.com"}, "request": true, "response": true}],
+//	  "limits": [{"name": "cdn", "host": "*.cdn.example.com", "down": 262144}],
+//	  "faults": [{"match": {"path": "^/api/"}, "fault": "status", "status": 429, "retryAfter": "30s", "probability": 0.1}],
+//	  "websocket": [{"match": {"host": "ws.example.com"}, "direction": "receive", "payload": "ping", "action": "drop"}]
+//	}
+type Rules struct {
+	Rewrite   []*RewriteRule   `json:"rewrite"`
+	MapLocal  []*MapLocalRule  `json:"mapLocal"`
+	MapRemote []*MapRemoteRule `json:"mapRemote"`
+	// 需要 ProxyHandler.Breakpoints
+	Breakpoints []*BreakpointRule `json:"breakpoints"`
+	Limits      []*LimitRule      `json:"limits"`
+	Faults      []*FaultRule      `json:"faults"`
+	WebSocket   []*WebSocketRule  `json:"websocket"`
+}
+
+// Match matches a request, 零值的字段不参与匹配
+type Match struct {
+	// 支持 *.example.com 这样的通配
+	Host string `json:"host,omitempty"`
+	// 正则
+	Path   string `json:"path,omitempty"`
+	Method string `json:"method,omitempty"`
+	// header 的值是正则
+	Header map[string]string `json:"header,omitempty"`
+
+	path   *regexp.Regexp
+	header map[string]*regexp.Regexp
+}
+
+// RewriteRule changes matched requests and their responses
+type RewriteRule struct {
+	Name     string         `json:"name,omitempty"`
+	Match    Match          `json:"match"`
+	Request  *RewriteAction `json:"request,omitempty"`
+	Response *RewriteAction `json:"response,omitempty"`
+}
+
+// RewriteAction is what to do with a request or response
+type RewriteAction struct {
+	SetHeader    map[string]string `json:"setHeader,omitempty"`
+	RemoveHeader []string          `json:"removeHeader,omitempty"`
+	// 只用于请求, 对完整的 url 做正则替换
+	URL         *Replace   `json:"url,omitempty"`
+	ReplaceBody []*Replace `json:"replaceBody,omitempty"`
+	// 只用于响应
+	Status int      `json:"status,omitempty"`
+	Delay  Duration `json:"delay,omitempty"`
+}
+
+// Replace replaces all matches of Pattern with With, With 里可以使用 $1
+type Replace struct {
+	Pattern string `json:"pattern"`
+	With    string `json:"with"`
+
+	re *regexp.Regexp
+}
+
+// LoadRules loads rules from a json file
+func LoadRules(file string) (*Rules, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	rules := new(Rules)
+	if err := json.Unmarshal(data, rules); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	if err := rules.compile(); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return rules, nil
+}
+
+func (r *Rules) compile() error {
+	for _, rule := range r.Rewrite {
+		if err := rule.Match.compile(); err != nil {
+			return err
+		}
+		for _, a := range []*RewriteAction{rule.Request, rule.Response} {
+			if a == nil {
+				continue
+			}
+			if err := a.compile(); err != nil {
+				return err
+			}
+		}
+	}
+	for _, rule := range r.MapLocal {
+		if err := rule.Match.compile(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range r.MapRemote {
+		if err := rule.compile(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range r.Breakpoints {
+		if err := rule.Match.compile(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range r.Limits {
+		if err := rule.compile(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range r.Faults {
+		if err := rule.compile(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range r.WebSocket {
+		if err := rule.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Match) compile() (err error) {
+	if m.Path != "" {
+		if m.path, err = regexp.Compile(m.Path); err != nil {
+			return
+		}
+	}
+	m.header = make(map[string]*regexp.Regexp, len(m.Header))
+	for k, v := range m.Header {
+		if m.header[k], err = regexp.Compile(v); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (m *Match) match(req *http.Request) bool {
+	if m.Host != "" && !matchHost(m.Host, req.URL.Hostname()) {
+		return false
+	}
+	if m.Method != "" && !strings.EqualFold(m.Method, req.Method) {
+		return false
+	}
+	if m.path != nil && !m.path.MatchString(req.URL.Path) {
+		return false
+	}
+	for k, re := range m.header {
+		if !re.MatchString(req.Header.Get(k)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *RewriteAction) compile() error {
+	for _, r := range append([]*Replace{a.URL}, a.ReplaceBody...) {
+		if r == nil {
+			continue
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return err
+		}
+		r.re = re
+	}
+	return nil
+}
+
+func (r *Rules) matchRewrite(req *http.Request) []*RewriteRule {
+	var rules []*RewriteRule
+	for _, rule := range r.Rewrite {
+		if rule.Match.match(req) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func (a *RewriteAction) rewriteRequest(req *http.Request) error {
+	if err := sleep(req.Context(), time.Duration(a.Delay)); err != nil {
+		return err
+	}
+	rewriteHeader(req.Header, a)
+	if a.URL != nil {
+		u, err := url.Parse(a.URL.re.ReplaceAllString(req.URL.String(), a.URL.With))
+		if err != nil {
+			return err
+		}
+		if u.Host != req.URL.Host {
+			req.Host = ""
+		}
+		req.URL = u
+	}
+	if len(a.ReplaceBody) > 0 && req.Body != nil && req.Body != http.NoBody {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return err
+		}
+		body = replaceAll(a.ReplaceBody, body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		req.Header.Del("Transfer-Encoding")
+	}
+	return nil
+}
+
+func (a *RewriteAction) rewriteResponse(res *http.Response) error {
+	if err := sleep(res.Request.Context(), time.Duration(a.Delay)); err != nil {
+		return err
+	}
+	rewriteHeader(res.Header, a)
+	if a.Status != 0 {
+		res.StatusCode = a.Status
+		res.Status = fmt.Sprintf("%d %s", a.Status, http.StatusText(a.Status))
+	}
+	if len(a.ReplaceBody) > 0 {
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		// 压缩过的 body 需要先解压才能替换
+		if decoded, err := decodeBody(res.Header.Get("Content-Encoding"), body); err == nil {
+			body = decoded
+			res.Header.Del("Content-Encoding")
+		}
+		setResponseBody(res, replaceAll(a.ReplaceBody, body))
+	}
+	return nil
+}
+
+func setResponseBody(res *http.Response, body []byte) {
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.TransferEncoding = nil
+	res.Header.Del("Transfer-Encoding")
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+func rewriteHeader(h http.Header, a *RewriteAction) {
+	for _, k := range a.RemoveHeader {
+		h.Del(k)
+	}
+	for k, v := range a.SetHeader {
+		h.Set(k, v)
+	}
+}
+
+func replaceAll(rs []*Replace, body []byte) []byte {
+	for _, r := range rs {
+		body = r.re.ReplaceAll(body, []byte(r.With))
+	}
+	return body
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,560 @@
+package gproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dop251/goja"
+)
+
+// 脚本单次执行的最长时间, 避免死循环卡住请求
+const scriptTimeout = time.Second
+
+// 脚本能读取的最大 body, 更大的请求和响应不缓冲
+const maxScriptBody = 4 << 20
+
+var scriptBody = regexp.MustCompile(`\bbody\b`)
+
+// Scripts runs javascript hooks loaded from a directory, 按文件名顺序执行
+//
+//	function onConnect(host) { if (host == "pinned.example.com") return "tunnel" }
+//	function onRequest(flow) { flow.request.header["X-Debug"] = "1" }
+//	function onResponse(flow) { flow.response.body = flow.response.body.replace("foo", "bar") }
+//
+// onConnect 返回 false 拒绝连接, 返回 "tunnel" 不参与握手;
+// onRequest 里设置 flow.response 直接返回, 不再请求上游;
+// 源码里用到 body 的脚本执行之前才缓冲请求或者响应, 没有 body, 超过 4MB,
+// 不是 UTF-8 或者 text/event-stream 的 body 读到的是 undefined, body 保持原样
+type Scripts struct {
+	Dir string
+
+	mu      sync.RWMutex
+	scripts []*script
+	done    chan struct{}
+	once    sync.Once
+}
+
+// goja.Runtime 不能并发使用, 同一个脚本的 hook 串行执行
+type script struct {
+	name    string
+	modTime time.Time
+	size    int64
+
+	// 源码里用到了 body, 执行之前需要先读取
+	body bool
+
+	mu         sync.Mutex
+	vm         *goja.Runtime
+	onConnect  goja.Callable
+	onRequest  goja.Callable
+	onResponse goja.Callable
+}
+
+// LoadScripts loads all *.js files in dir
+func LoadScripts(dir string) (*Scripts, error) {
+	s := &Scripts{
+		Dir:  dir,
+		done: make(chan struct{}),
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload loads new and changed scripts, 编译失败时保留旧的版本
+func (s *Scripts) Reload() error {
+	files, err := filepath.Glob(filepath.Join(s.Dir, "*.js"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	s.mu.RLock()
+	old := make(map[string]*script, len(s.scripts))
+	for _, sc := range s.scripts {
+		old[sc.name] = sc
+	}
+	s.mu.RUnlock()
+	scripts := make([]*script, 0, len(files))
+	changed := len(files) != len(old)
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		sc, ok := old[file]
+		if ok && sc.modTime.Equal(fi.ModTime()) && sc.size == fi.Size() {
+			scripts = append(scripts, sc)
+			continue
+		}
+		changed = true
+		nsc, err := loadScript(file, fi)
+		if err != nil {
+			logger.Printf("script %s: %s", file, err)
+			if ok {
+				// 记录新的修改时间, 避免重复报错
+				sc.modTime, sc.size = fi.ModTime(), fi.Size()
+				scripts = append(scripts, sc)
+			}
+			continue
+		}
+		logger.Printf("script load %s", file)
+		scripts = append(scripts, nsc)
+	}
+	if changed {
+		s.mu.Lock()
+		s.scripts = scripts
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Watch reloads scripts every interval until Close
+func (s *Scripts) Watch(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := s.Reload(); err != nil {
+				logger.Printf("script reload %s: %s", s.Dir, err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Close stops Watch
+func (s *Scripts) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+func loadScript(file string, fi os.FileInfo) (*script, error) {
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	sc := &script{
+		name:    file,
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		body:    scriptBody.Match(src),
+		vm:      goja.New(),
+	}
+	name := filepath.Base(file)
+	sc.vm.Set("log", func(call goja.FunctionCall) goja.Value {
+		args := make([]string, len(call.Arguments))
+		for i, arg := range call.Arguments {
+			args[i] = arg.String()
+		}
+		logger.Printf("script %s: %s", name, strings.Join(args, " "))
+		return goja.Undefined()
+	})
+	if _, err := sc.vm.RunScript(name, string(src)); err != nil {
+		return nil, err
+	}
+	sc.onConnect, _ = goja.AssertFunction(sc.vm.Get("onConnect"))
+	sc.onRequest, _ = goja.AssertFunction(sc.vm.Get("onRequest"))
+	sc.onResponse, _ = goja.AssertFunction(sc.vm.Get("onResponse"))
+	return sc, nil
+}
+
+func (sc *script) call(fn goja.Callable, arg interface{}) goja.Value {
+	return sc.run(fn, func() goja.Value { return sc.vm.ToValue(arg) })
+}
+
+// run 在持有 sc.mu 时创建参数并调用 fn
+func (sc *script) run(fn goja.Callable, arg func() goja.Value) goja.Value {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	t := time.AfterFunc(scriptTimeout, func() {
+		sc.vm.Interrupt("timeout")
+	})
+	v, err := fn(goja.Undefined(), arg())
+	t.Stop()
+	sc.vm.ClearInterrupt()
+	if err != nil {
+		logger.Printf("script %s: %s", filepath.Base(sc.name), err)
+		return nil
+	}
+	return v
+}
+
+func (s *Scripts) list() []*script {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.scripts
+}
+
+// connect 返回 false 拒绝连接, tunnel 为 true 时不参与握手
+func (s *Scripts) connect(host string) (allow, tunnel bool) {
+	for _, sc := range s.list() {
+		if sc.onConnect == nil {
+			continue
+		}
+		v := sc.call(sc.onConnect, host)
+		if v == nil {
+			continue
+		}
+		switch v.Export() {
+		case false:
+			return false, false
+		case "tunnel":
+			tunnel = true
+		}
+	}
+	return true, tunnel
+}
+
+// request 执行 onRequest, 返回非 nil 的响应时不再请求上游
+func (s *Scripts) request(req *http.Request) (*http.Response, error) {
+	var scripts []*script
+	for _, sc := range s.list() {
+		if sc.onRequest != nil {
+			scripts = append(scripts, sc)
+		}
+	}
+	if len(scripts) == 0 {
+		return nil, nil
+	}
+	r := &jsRequest{
+		req:    req,
+		method: req.Method,
+		url:    req.URL.String(),
+		header: headerToJS(req.Header),
+	}
+	flow := map[string]interface{}{}
+	if f := flowFromContext(req.Context()); f != nil {
+		flow["id"] = f.ID
+	}
+	for _, sc := range scripts {
+		if sc.body && !r.loaded {
+			// 在 sc.mu 和超时之外读取, 不能让慢的客户端阻塞其他请求
+			r.load()
+		}
+		sc.run(sc.onRequest, func() goja.Value {
+			flow["request"] = r.object(sc.vm)
+			return sc.vm.ToValue(flow)
+		})
+		r.update(flow["request"])
+		if flow["response"] != nil {
+			break
+		}
+	}
+	if m, ok := flow["response"].(map[string]interface{}); ok {
+		res := &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Request:    req,
+		}
+		responseFromJS(res, m)
+		return res, nil
+	}
+	if r.method != "" && r.method != req.Method {
+		req.Method = r.method
+	}
+	if r.url != req.URL.String() {
+		u, err := url.Parse(r.url)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host != req.URL.Host {
+			req.Host = ""
+		}
+		req.URL = u
+	}
+	req.Header = headerFromJS(r.header)
+	if r.set {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(r.body))
+		req.ContentLength = int64(len(r.body))
+		req.Header.Set("Content-Length", strconv.Itoa(len(r.body)))
+		req.Header.Del("Transfer-Encoding")
+		req.Header.Del("Content-Encoding")
+	}
+	return nil, nil
+}
+
+// response 执行 onResponse, 直接修改 res
+func (s *Scripts) response(res *http.Response) error {
+	var scripts []*script
+	for _, sc := range s.list() {
+		if sc.onResponse != nil {
+			scripts = append(scripts, sc)
+		}
+	}
+	if len(scripts) == 0 {
+		return nil
+	}
+	req := res.Request
+	r := &jsResponse{
+		res:    res,
+		status: res.StatusCode,
+		header: headerToJS(res.Header),
+	}
+	flow := map[string]interface{}{
+		"request": map[string]interface{}{
+			"method": req.Method,
+			"url":    req.URL.String(),
+			"header": headerToJS(req.Header),
+		},
+	}
+	if f := flowFromContext(req.Context()); f != nil {
+		flow["id"] = f.ID
+	}
+	for _, sc := range scripts {
+		if sc.body && !r.loaded {
+			// 在 sc.mu 和超时之外读取, 不能让慢的上游阻塞其他响应
+			r.load()
+		}
+		sc.run(sc.onResponse, func() goja.Value {
+			// goja 的对象不能跨 Runtime, 每个脚本单独创建
+			flow["response"] = r.object(sc.vm)
+			return sc.vm.ToValue(flow)
+		})
+		r.update(flow["response"])
+	}
+	if r.status != res.StatusCode {
+		res.StatusCode = r.status
+		res.Status = fmt.Sprintf("%d %s", res.StatusCode, http.StatusText(res.StatusCode))
+	}
+	res.Header = headerFromJS(r.header)
+	if r.set && !bodyless(res) {
+		res.Body.Close()
+		setResponseBody(res, r.body)
+		res.Header.Del("Content-Encoding")
+	}
+	return nil
+}
+
+// jsBody 是脚本看到的 body, 多个脚本共享
+type jsBody struct {
+	loaded bool
+	// 解压之后的 body, 不能给脚本使用时 ok 为 false
+	text string
+	ok   bool
+	// 脚本设置了新的 body
+	set  bool
+	body []byte
+}
+
+// read 读取最多 maxScriptBody 的 body, 太大或者出错时已经读取的部分放回去
+func (b *jsBody) read(body *io.ReadCloser, encoding string, size int64) {
+	b.loaded = true
+	rc := *body
+	if rc == nil || rc == http.NoBody || size > maxScriptBody {
+		return
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(rc, maxScriptBody+1))
+	if err != nil || len(raw) > maxScriptBody {
+		// 剩下的继续流式转发
+		*body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(raw), rc), rc}
+		return
+	}
+	rc.Close()
+	*body = ioutil.NopCloser(bytes.NewReader(raw))
+	text, err := decodeBody(encoding, raw)
+	if err != nil || !utf8.Valid(text) {
+		return
+	}
+	b.text, b.ok = string(text), true
+}
+
+// define 给 obj 添加 body 属性, 没有读取时是 undefined
+func (b *jsBody) define(vm *goja.Runtime, obj *goja.Object) {
+	get := func(goja.FunctionCall) goja.Value {
+		if b.set {
+			return vm.ToValue(string(b.body))
+		}
+		if !b.ok {
+			return goja.Undefined()
+		}
+		return vm.ToValue(b.text)
+	}
+	set := func(call goja.FunctionCall) goja.Value {
+		b.set = true
+		b.body = []byte(jsString(call.Argument(0).Export()))
+		return goja.Undefined()
+	}
+	obj.DefineAccessorProperty("body", vm.ToValue(get), vm.ToValue(set), goja.FLAG_FALSE, goja.FLAG_TRUE)
+}
+
+// jsRequest 是脚本看到的 flow.request
+type jsRequest struct {
+	req    *http.Request
+	method string
+	url    string
+	header map[string]interface{}
+	jsBody
+}
+
+func (r *jsRequest) object(vm *goja.Runtime) *goja.Object {
+	obj := vm.NewObject()
+	obj.Set("method", r.method)
+	obj.Set("url", r.url)
+	obj.Set("header", r.header)
+	r.define(vm, obj)
+	return obj
+}
+
+// update 读回脚本修改的 method, url 和 header, 脚本也可以整个替换 flow.request
+func (r *jsRequest) update(v interface{}) {
+	switch v := v.(type) {
+	case *goja.Object:
+		r.method = jsString(v.Get("method").Export())
+		r.url = jsString(v.Get("url").Export())
+		r.header = headerToJS(headerFromJS(v.Get("header").Export()))
+	case map[string]interface{}:
+		r.method = jsString(v["method"])
+		r.url = jsString(v["url"])
+		r.header = headerToJS(headerFromJS(v["header"]))
+		r.set = true
+		r.body = []byte(jsString(v["body"]))
+	}
+}
+
+func (r *jsRequest) load() {
+	req := r.req
+	r.read(&req.Body, req.Header.Get("Content-Encoding"), req.ContentLength)
+}
+
+// jsResponse 是脚本看到的 flow.response
+type jsResponse struct {
+	res    *http.Response
+	status int
+	header map[string]interface{}
+	jsBody
+}
+
+func (r *jsResponse) object(vm *goja.Runtime) *goja.Object {
+	obj := vm.NewObject()
+	obj.Set("status", r.status)
+	obj.Set("header", r.header)
+	r.define(vm, obj)
+	return obj
+}
+
+// update 读回脚本修改的 status 和 header, 脚本也可以整个替换 flow.response
+func (r *jsResponse) update(v interface{}) {
+	switch v := v.(type) {
+	case *goja.Object:
+		if status, ok := jsInt(v.Get("status").Export()); ok && status > 0 {
+			r.status = status
+		}
+		r.header = headerToJS(headerFromJS(v.Get("header").Export()))
+	case map[string]interface{}:
+		if status, ok := jsInt(v["status"]); ok && status > 0 {
+			r.status = status
+		}
+		r.header = headerToJS(headerFromJS(v["header"]))
+		r.set = true
+		r.body = []byte(jsString(v["body"]))
+	}
+}
+
+// load 读取 body, 没有 body 或者是事件流的响应保持原样
+func (r *jsResponse) load() {
+	res := r.res
+	if bodyless(res) || strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		r.loaded = true
+		return
+	}
+	r.read(&res.Body, res.Header.Get("Content-Encoding"), res.ContentLength)
+}
+
+// bodyless 判断响应是否没有 body, 101 之后的 body 是连接
+func bodyless(res *http.Response) bool {
+	return res.Request != nil && res.Request.Method == "HEAD" ||
+		res.StatusCode < 200 || res.StatusCode == http.StatusNoContent ||
+		res.StatusCode == http.StatusNotModified
+}
+
+func responseFromJS(res *http.Response, m map[string]interface{}) {
+	if status, ok := jsInt(m["status"]); ok && status > 0 {
+		res.StatusCode = status
+	}
+	res.Status = fmt.Sprintf("%d %s", res.StatusCode, http.StatusText(res.StatusCode))
+	if h, ok := m["header"]; ok {
+		res.Header = headerFromJS(h)
+	}
+	setResponseBody(res, []byte(jsString(m["body"])))
+}
+
+// 只有一个值的 header 用字符串表示, 否则用数组
+func headerToJS(h http.Header) map[string]interface{} {
+	m := make(map[string]interface{}, len(h))
+	for k, vs := range h {
+		if len(vs) == 1 {
+			m[k] = vs[0]
+			continue
+		}
+		a := make([]interface{}, len(vs))
+		for i, v := range vs {
+			a[i] = v
+		}
+		m[k] = a
+	}
+	return m
+}
+
+func headerFromJS(v interface{}) http.Header {
+	h := make(http.Header)
+	m, _ := v.(map[string]interface{})
+	for k, v := range m {
+		switch v := v.(type) {
+		case nil:
+		case []interface{}:
+			for _, s := range v {
+				h.Add(k, jsString(s))
+			}
+		default:
+			h.Add(k, jsString(v))
+		}
+	}
+	return h
+}
+
+func jsString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+func jsInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case int64:
+		return int(n), true
+	case float64:
+		return int(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,142 @@
+package gproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testScripts(t *testing.T, src string) *Scripts {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "test.js"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := LoadScripts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// slowBody 等待 delay 之后才返回数据
+type slowBody struct {
+	delay time.Duration
+	r     io.Reader
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	if b.delay > 0 {
+		time.Sleep(b.delay)
+		b.delay = 0
+	}
+	return b.r.Read(p)
+}
+
+func (b *slowBody) Close() error { return nil }
+
+func testResponse(body io.ReadCloser) *http.Response {
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"text/plain"}},
+		Body:          body,
+		ContentLength: -1,
+		Request:       req,
+	}
+}
+
+// 慢的上游不占用脚本的锁和超时, 其他响应不用排队
+func TestScriptsSlowResponseBody(t *testing.T) {
+	s := testScripts(t, `function onResponse(flow) { flow.response.body = flow.response.body.toUpperCase() }`)
+	slow := testResponse(&slowBody{delay: scriptTimeout + 500*time.Millisecond, r: strings.NewReader("slow")})
+	done := make(chan error, 1)
+	go func() { done <- s.response(slow) }()
+
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	fast := testResponse(ioutil.NopCloser(strings.NewReader("fast")))
+	if err := s.response(fast); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > scriptTimeout/2 {
+		t.Errorf("fast response waited %s", d)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		res  *http.Response
+		want string
+	}{{fast, "FAST"}, {slow, "SLOW"}} {
+		body, _ := ioutil.ReadAll(tt.res.Body)
+		if string(body) != tt.want {
+			t.Errorf("got %q, want %q", body, tt.want)
+		}
+	}
+}
+
+func TestScriptsRequestBody(t *testing.T) {
+	large := bytes.Repeat([]byte("a"), maxScriptBody+1)
+	tests := []struct {
+		name string
+		src  string
+		body []byte
+		want string
+		// 脚本看到的 body
+		seen string
+	}{
+		{"rewrite", `function onRequest(flow) { flow.request.header["X-Seen"] = String(flow.request.body).slice(0, 16); flow.request.body = "new" }`,
+			[]byte("old"), "new", "old"},
+		{"too large", `function onRequest(flow) { flow.request.header["X-Seen"] = String(flow.request.body).slice(0, 16) }`,
+			large, string(large), "undefined"},
+		{"binary", `function onRequest(flow) { flow.request.header["X-Seen"] = String(flow.request.body).slice(0, 16) }`,
+			[]byte{0xff, 0xfe, 0}, "\xff\xfe\x00", "undefined"},
+	}
+	for _, tt := range tests {
+		s := testScripts(t, tt.src)
+		req, _ := http.NewRequest("POST", "http://example.com/", bytes.NewReader(tt.body))
+		if _, err := s.request(req); err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		if string(body) != tt.want {
+			t.Errorf("%s: body %d bytes, want %d", tt.name, len(body), len(tt.want))
+		}
+		if req.ContentLength != int64(len(tt.want)) {
+			t.Errorf("%s: ContentLength %d, want %d", tt.name, req.ContentLength, len(tt.want))
+		}
+		if seen := req.Header.Get("X-Seen"); seen != tt.seen {
+			t.Errorf("%s: script saw %q, want %q", tt.name, seen, tt.seen)
+		}
+	}
+}
+
+// 只改 header 的脚本不读取请求的 body, 上传的数据继续流式转发
+func TestScriptsRequestStreaming(t *testing.T) {
+	s := testScripts(t, `function onRequest(flow) { flow.request.header["X-Debug"] = "1" }`)
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, _ := http.NewRequest("POST", "http://example.com/upload", pr)
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.request(req)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("onRequest waited for the request body")
+	}
+	if req.Header.Get("X-Debug") != "1" || req.Body != pr {
+		t.Fatalf("header %v, body replaced %v", req.Header, req.Body != pr)
+	}
+}
@@ -0,0 +1,182 @@
+package gproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Snapshot answers requests from recorded flows instead of upstream
+type Snapshot struct {
+	// 没有匹配的请求交给上游, 否则直接返回错误
+	Fallthrough bool
+
+	match   SnapshotMatch
+	mu      sync.Mutex
+	entries map[string]*snapshotEntry
+}
+
+// SnapshotMatch decides which parts of a request must equal the recorded one,
+// url 的 scheme/host/path 总是参与匹配, query 参数会排序后比较
+type SnapshotMatch struct {
+	IgnoreMethod bool
+	// 忽略整个 query
+	IgnoreQuery bool
+	// 忽略部分 query 参数, 比如时间戳
+	IgnoreParams []string
+	// 比较 body 的 hash
+	Body bool
+}
+
+// 相同的请求有多个响应时按顺序循环返回
+type snapshotEntry struct {
+	flows []*Flow
+	next  int
+}
+
+type snapshotMiss struct {
+	method, url string
+}
+
+func (e *snapshotMiss) Error() string {
+	return fmt.Sprintf("snapshot miss: %s %s", e.method, e.url)
+}
+
+// LoadSnapshot loads recorded flows from a HAR file
+func LoadSnapshot(file string, match SnapshotMatch) (*Snapshot, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	flows, err := ImportHAR(fp)
+	if err != nil {
+		return nil, err
+	}
+	return NewSnapshot(flows, match), nil
+}
+
+// NewSnapshot returns a Snapshot of flows, 没有响应的 flow 会被忽略
+func NewSnapshot(flows []*Flow, match SnapshotMatch) *Snapshot {
+	s := &Snapshot{
+		match:   match,
+		entries: make(map[string]*snapshotEntry),
+	}
+	for _, f := range flows {
+		if f.Response == nil {
+			continue
+		}
+		key, err := s.key(f.Request.Method, f.Request.URL, f.Request.Body)
+		if err != nil {
+			logger.Printf("snapshot skip %s %s", f.Request.URL, err)
+			continue
+		}
+		e, ok := s.entries[key]
+		if !ok {
+			e = &snapshotEntry{}
+			s.entries[key] = e
+		}
+		e.flows = append(e.flows, f)
+	}
+	return s
+}
+
+// Len returns the number of distinct requests
+func (s *Snapshot) Len() int {
+	return len(s.entries)
+}
+
+func (s *Snapshot) key(method, rawurl string, body []byte) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if !s.match.IgnoreMethod {
+		b.WriteString(strings.ToUpper(method))
+	}
+	b.WriteByte(' ')
+	b.WriteString(strings.ToLower(u.Scheme))
+	b.WriteString("://")
+	b.WriteString(strings.ToLower(canonicalAddr(u)))
+	b.WriteString(u.EscapedPath())
+	if !s.match.IgnoreQuery {
+		q := u.Query()
+		for _, p := range s.match.IgnoreParams {
+			q.Del(p)
+		}
+		// Encode 会按照 key 排序
+		if enc := q.Encode(); enc != "" {
+			b.WriteByte('?')
+			b.WriteString(enc)
+		}
+	}
+	if s.match.Body {
+		fmt.Fprintf(&b, " %x", sha256.Sum256(body))
+	}
+	return b.String(), nil
+}
+
+// 去掉默认端口, 参与握手的请求 url 里会带上 CONNECT 的端口
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" || u.Scheme == "https" && port == "443" || u.Scheme == "http" && port == "80" {
+		return u.Hostname()
+	}
+	return u.Host
+}
+
+func (s *Snapshot) roundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if s.match.Body && req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	key, err := s.key(req.Method, req.URL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	e, ok := s.entries[key]
+	var f *Flow
+	if ok {
+		f = e.flows[e.next]
+		e.next = (e.next + 1) % len(e.flows)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, &snapshotMiss{method: req.Method, url: req.URL.String()}
+	}
+	logger.Printf("snapshot hit %s %s", req.Method, req.URL)
+	return newFlowResponse(req, f.Response), nil
+}
+
+// newFlowResponse 用记录的响应构造 http.Response
+func newFlowResponse(req *http.Request, r *FlowResponse) *http.Response {
+	header := cloneHeader(r.Header)
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(r.Body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.StatusCode, http.StatusText(r.StatusCode)),
+		StatusCode:    r.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(r.Body)),
+		ContentLength: int64(len(r.Body)),
+		Request:       req,
+	}
+}
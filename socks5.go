@@ -0,0 +1,562 @@
+package gproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RFC 1928, RFC 1929
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0x00
+	socksUserPass     = 0x02
+	socksNoAcceptable = 0xff
+
+	socksConnect      = 1
+	socksUDPAssociate = 3
+
+	socksIPv4   = 1
+	socksDomain = 3
+	socksIPv6   = 4
+
+	socksSucceeded           = 0
+	socksGeneralFailure      = 1
+	socksNotAllowed          = 2
+	socksNetworkUnreachable  = 3
+	socksHostUnreachable     = 4
+	socksConnectionRefused   = 5
+	socksCommandNotSupported = 7
+	socksAddrNotSupported    = 8
+)
+
+var (
+	errSocksVersion = errors.New("socks: unsupported version")
+	errSocksAuth    = errors.New("socks: authentication failed")
+	errSocksAddr    = errors.New("socks: unsupported address type")
+)
+
+// SOCKS5 is a socks5 server sharing the pipeline of ProxyHandler,
+// 80/443 端口的连接嗅探之后交给 Proxy 处理, 其它连接直接转发
+type SOCKS5 struct {
+	// nil 时所有连接直接转发
+	Proxy *ProxyHandler
+	// 用户名和密码, 空不需要认证
+	Users map[string]string
+	// 握手的超时时间, 0 不限制
+	ReadTimeout time.Duration
+
+	inShutdown int32
+	mu         sync.Mutex
+	listener   net.Listener
+	activeConn map[net.Conn]struct{}
+}
+
+// ListenAndServe listens on the TCP network address and serves socks5 clients
+func (s *SOCKS5) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)})
+}
+
+// Serve accepts connections on ln until Close
+func (s *SOCKS5) Serve(ln net.Listener) error {
+	ln = &onceCloseListener{Listener: ln}
+	defer ln.Close()
+	s.mu.Lock()
+	s.listener = ln
+	s.mu.Unlock()
+	var tempDelay time.Duration
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&s.inShutdown) != 0 {
+				return errServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				logger.Printf("socks accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		s.trackConn(c, true)
+		go func() {
+			defer s.trackConn(c, false)
+			defer c.Close()
+			if err := s.serveConn(c); err != nil {
+				logger.Printf("socks %s: %s", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Close immediately closes the listener and all connections
+func (s *SOCKS5) Close() (err error) {
+	atomic.StoreInt32(&s.inShutdown, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for c := range s.activeConn {
+		c.Close()
+		delete(s.activeConn, c)
+	}
+	return
+}
+
+// Shutdown stops accepting connections and waits for active ones until ctx is done,
+// 然后强制关闭剩下的连接
+func (s *SOCKS5) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.inShutdown, 1)
+	s.mu.Lock()
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	s.mu.Unlock()
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
+	for {
+		s.mu.Lock()
+		n := len(s.activeConn)
+		s.mu.Unlock()
+		if n == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func (s *SOCKS5) trackConn(c net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.activeConn == nil {
+		s.activeConn = make(map[net.Conn]struct{})
+	}
+	if add {
+		s.activeConn[c] = struct{}{}
+	} else {
+		delete(s.activeConn, c)
+	}
+}
+
+func (s *SOCKS5) serveConn(c net.Conn) error {
+	if d := s.ReadTimeout; d > 0 {
+		c.SetDeadline(time.Now().Add(d))
+	}
+	br := bufio.NewReader(c)
+	if err := s.auth(br, c); err != nil {
+		return err
+	}
+	// VER CMD RSV ATYP DST.ADDR DST.PORT
+	var hdr [3]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socksVersion {
+		return errSocksVersion
+	}
+	host, port, err := readSocksAddr(br)
+	if err != nil {
+		socksReply(c, socksAddrNotSupported, nil)
+		return err
+	}
+	c.SetDeadline(time.Time{})
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	switch hdr[1] {
+	case socksConnect:
+		// 客户端在收到响应之前不会发送数据, br 里没有剩下的
+		return s.connect(c, host, port, addr)
+	case socksUDPAssociate:
+		return s.udpAssociate(c)
+	}
+	socksReply(c, socksCommandNotSupported, nil)
+	return fmt.Errorf("socks: unsupported command %d", hdr[1])
+}
+
+// auth 协商认证方法, 设置了 Users 时只接受用户名密码
+func (s *SOCKS5) auth(br *bufio.Reader, w io.Writer) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socksVersion {
+		return errSocksVersion
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return err
+	}
+	want := byte(socksNoAuth)
+	if len(s.Users) > 0 {
+		want = socksUserPass
+	}
+	found := false
+	for _, m := range methods {
+		if m == want {
+			found = true
+			break
+		}
+	}
+	if !found {
+		w.Write([]byte{socksVersion, socksNoAcceptable})
+		return errSocksAuth
+	}
+	if _, err := w.Write([]byte{socksVersion, want}); err != nil {
+		return err
+	}
+	if want == socksNoAuth {
+		return nil
+	}
+	// VER ULEN UNAME PLEN PASSWD
+	ver, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	user, err := readSocksString(br)
+	if err != nil {
+		return err
+	}
+	pass, err := readSocksString(br)
+	if err != nil {
+		return err
+	}
+	if p, ok := s.Users[user]; ver != 1 || !ok || p != pass {
+		w.Write([]byte{1, 1})
+		return errSocksAuth
+	}
+	_, err = w.Write([]byte{1, 0})
+	return err
+}
+
+func readSocksString(br *bufio.Reader) (string, error) {
+	n, err := br.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func readSocksAddr(r io.Reader) (host string, port int, err error) {
+	var atyp [1]byte
+	if _, err = io.ReadFull(r, atyp[:]); err != nil {
+		return
+	}
+	var b []byte
+	switch atyp[0] {
+	case socksIPv4:
+		b = make([]byte, net.IPv4len+2)
+	case socksIPv6:
+		b = make([]byte, net.IPv6len+2)
+	case socksDomain:
+		var n [1]byte
+		if _, err = io.ReadFull(r, n[:]); err != nil {
+			return
+		}
+		b = make([]byte, int(n[0])+2)
+	default:
+		err = errSocksAddr
+		return
+	}
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+	if atyp[0] == socksDomain {
+		host = string(b[:len(b)-2])
+	} else {
+		host = net.IP(b[:len(b)-2]).String()
+	}
+	port = int(binary.BigEndian.Uint16(b[len(b)-2:]))
+	return
+}
+
+// appendSocksAddr 编码地址, nil 时是 0.0.0.0:0
+func appendSocksAddr(b []byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil || ip == nil {
+		if ip4 == nil {
+			ip4 = net.IPv4zero.To4()
+		}
+		b = append(append(b, socksIPv4), ip4...)
+	} else {
+		b = append(append(b, socksIPv6), ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+func socksReply(w io.Writer, rep byte, bind net.Addr) error {
+	_, err := w.Write(appendSocksAddr([]byte{socksVersion, rep, 0}, bind))
+	return err
+}
+
+// socksDialError 把连接上游的错误转换成响应码
+func socksDialError(err error) byte {
+	if oe, ok := err.(*net.OpError); ok {
+		if _, ok := oe.Err.(*net.DNSError); ok {
+			return socksHostUnreachable
+		}
+		if oe.Timeout() {
+			return socksHostUnreachable
+		}
+		return socksConnectionRefused
+	}
+	return socksGeneralFailure
+}
+
+func (s *SOCKS5) connect(c net.Conn, host string, port int, addr string) error {
+	ph := s.Proxy
+	if ph != nil {
+		ph.trackConn(c, true)
+		defer ph.trackConn(c, false)
+	}
+	if ph == nil || port != 80 && port != 443 {
+		return s.tunnel(c, host, addr)
+	}
+	logger.Printf("socks connect %s", addr)
+	// 80 和 443 先回复再嗅探, 其它的连接失败时才能告诉客户端
+	intercept, status := ph.connectMode(host, addr, true)
+	if status != 0 {
+		socksReply(c, socksNotAllowed, nil)
+		return nil
+	}
+	if !intercept {
+		return s.tunnel(c, host, addr)
+	}
+	if err := socksReply(c, socksSucceeded, c.LocalAddr()); err != nil {
+		return err
+	}
+	conn := ph.wrapConn(c, host, c.RemoteAddr().String())
+	sc := &sniffConn{Conn: conn, r: bufio.NewReader(conn)}
+	switch sniff(sc.r) {
+	case "tls":
+		if ph.certStore() != nil || ph.contains(host) {
+			ph.tls(host, addr, ph.faultConn(sc, socksRequest(c, addr), addr, true))
+			return nil
+		}
+	case "http":
+		ph.serveH1(sc, ph.connHandler("http", addr))
+		return nil
+	}
+	if ph.offline() {
+		logger.Printf("snapshot refuse tunnel %s \n", addr)
+		return nil
+	}
+	backend, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	buf := ph.BufferPool.Get()
+	defer ph.BufferPool.Put(buf)
+	tunnel(ph.faultConn(sc, socksRequest(c, addr), addr, false), backend, buf)
+	return nil
+}
+
+// tunnel 连接上游之后再回复, 然后直接转发
+func (s *SOCKS5) tunnel(c net.Conn, host, addr string) error {
+	logger.Printf("socks tunnel %s", addr)
+	backend, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		socksReply(c, socksDialError(err), nil)
+		return err
+	}
+	defer backend.Close()
+	if err := socksReply(c, socksSucceeded, backend.LocalAddr()); err != nil {
+		return err
+	}
+	var conn net.Conn = c
+	if ph := s.Proxy; ph != nil {
+		conn = ph.faultConn(ph.wrapConn(c, host, c.RemoteAddr().String()), socksRequest(c, addr), addr, false)
+	}
+	buf := defaultBufferPool.Get()
+	defer defaultBufferPool.Put(buf)
+	tunnel(conn, backend, buf)
+	return nil
+}
+
+// socksRequest 用于匹配规则
+func socksRequest(c net.Conn, addr string) *http.Request {
+	return &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: addr},
+		Host:       addr,
+		Header:     make(http.Header),
+		RemoteAddr: c.RemoteAddr().String(),
+	}
+}
+
+// sniff 根据第一个字节判断协议: tls, http 或者空
+func sniff(br *bufio.Reader) string {
+	b, err := br.Peek(1)
+	if err != nil {
+		return ""
+	}
+	// 22 是 tls handshake
+	if b[0] == 22 {
+		return "tls"
+	}
+	// http 方法都是大写字母, 再确认一下第一个空格之前的内容
+	if b[0] < 'A' || b[0] > 'Z' {
+		return ""
+	}
+	for n := 2; n <= 8; n++ {
+		b, err := br.Peek(n)
+		if err != nil {
+			return ""
+		}
+		c := b[n-1]
+		if c == ' ' {
+			return "http"
+		}
+		if c < 'A' || c > 'Z' {
+			return ""
+		}
+	}
+	return ""
+}
+
+// sniffConn 先读取嗅探时缓存的数据
+type sniffConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *sniffConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// udpAssociate 在 tcp 连接关闭之前转发客户端的 udp 包
+func (s *SOCKS5) udpAssociate(c net.Conn) error {
+	host, _, _ := net.SplitHostPort(c.LocalAddr().String())
+	relay, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		socksReply(c, socksGeneralFailure, nil)
+		return err
+	}
+	defer relay.Close()
+	upstream, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		socksReply(c, socksGeneralFailure, nil)
+		return err
+	}
+	defer upstream.Close()
+	if err := socksReply(c, socksSucceeded, relay.LocalAddr()); err != nil {
+		return err
+	}
+	logger.Printf("socks udp associate %s -> %s", c.RemoteAddr(), relay.LocalAddr())
+	u := &udpRelay{
+		relay:    relay,
+		upstream: upstream,
+		clientIP: net.ParseIP(clientIP(c.RemoteAddr().String())),
+	}
+	go u.fromClient()
+	go u.fromUpstream()
+	// tcp 连接关闭时结束
+	io.Copy(ioutil.Discard, c)
+	return nil
+}
+
+type udpRelay struct {
+	relay, upstream net.PacketConn
+	clientIP        net.IP
+
+	mu     sync.Mutex
+	client net.Addr
+}
+
+// fromClient 去掉 socks 头转发给目标
+func (u *udpRelay) fromClient() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := u.relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		// 只接受发起 associate 的客户端
+		if ua, ok := from.(*net.UDPAddr); !ok || !ua.IP.Equal(u.clientIP) {
+			continue
+		}
+		// RSV RSV FRAG ATYP DST.ADDR DST.PORT DATA, 不支持分片
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		host, port, err := readSocksAddr(r)
+		if err != nil {
+			continue
+		}
+		dst, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+		u.mu.Lock()
+		u.client = from
+		u.mu.Unlock()
+		u.upstream.WriteTo(buf[n-r.Len():n], dst)
+	}
+}
+
+// fromUpstream 加上 socks 头发回客户端
+func (u *udpRelay) fromUpstream() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := u.upstream.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		u.mu.Lock()
+		client := u.client
+		u.mu.Unlock()
+		if client == nil {
+			continue
+		}
+		pkt := appendSocksAddr([]byte{0, 0, 0}, from)
+		u.relay.WriteTo(append(pkt, buf[:n]...), client)
+	}
+}
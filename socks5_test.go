@@ -0,0 +1,274 @@
+package gproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startSOCKS5(t *testing.T, s *SOCKS5) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String()
+}
+
+// socksHandshake 协商认证方法, user 不为空时使用用户名密码
+func socksHandshake(c net.Conn, br *bufio.Reader, user, pass string) error {
+	method := byte(socksNoAuth)
+	if user != "" {
+		method = socksUserPass
+	}
+	c.Write([]byte{socksVersion, 1, method})
+	var rep [2]byte
+	if _, err := io.ReadFull(br, rep[:]); err != nil {
+		return err
+	}
+	if rep[1] != method {
+		return fmt.Errorf("method %#x", rep[1])
+	}
+	if user == "" {
+		return nil
+	}
+	b := append([]byte{1, byte(len(user))}, user...)
+	b = append(append(b, byte(len(pass))), pass...)
+	c.Write(b)
+	if _, err := io.ReadFull(br, rep[:]); err != nil {
+		return err
+	}
+	if rep[1] != 0 {
+		return fmt.Errorf("auth status %d", rep[1])
+	}
+	return nil
+}
+
+// socksRequestTo 发送命令, 地址是 IP 时用 ATYP 1/4, 否则用域名, 返回响应码和 BND 地址
+func socksRequestTo(c net.Conn, br *bufio.Reader, cmd byte, addr string) (byte, string, error) {
+	host, port, _ := net.SplitHostPort(addr)
+	b := []byte{socksVersion, cmd, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		b = append(append(b, socksDomain, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, socksIPv4), ip4...)
+	} else {
+		b = append(append(b, socksIPv6), ip...)
+	}
+	p, _ := strconv.Atoi(port)
+	b = append(b, byte(p>>8), byte(p))
+	c.Write(b)
+	var hdr [3]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return 0, "", err
+	}
+	bhost, bport, err := readSocksAddr(br)
+	return hdr[1], net.JoinHostPort(bhost, strconv.Itoa(bport)), err
+}
+
+func dialSOCKS5(t *testing.T, proxy string) (net.Conn, *bufio.Reader) {
+	c, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c, bufio.NewReader(c)
+}
+
+func TestSOCKS5Auth(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	tests := []struct {
+		name       string
+		users      map[string]string
+		user, pass string
+		ok         bool
+	}{
+		{"no auth", nil, "", "", true},
+		{"user pass", map[string]string{"alice": "secret"}, "alice", "secret", true},
+		{"wrong pass", map[string]string{"alice": "secret"}, "alice", "guess", false},
+		{"unknown user", map[string]string{"alice": "secret"}, "bob", "secret", false},
+		{"no auth offered", map[string]string{"alice": "secret"}, "", "", false},
+	}
+	for _, tt := range tests {
+		addr := startSOCKS5(t, &SOCKS5{Users: tt.users})
+		c, br := dialSOCKS5(t, addr)
+		err := socksHandshake(c, br, tt.user, tt.pass)
+		if tt.ok != (err == nil) {
+			t.Errorf("%s: handshake %v", tt.name, err)
+			continue
+		}
+		if !tt.ok {
+			// 认证失败之后服务器关闭连接
+			if _, err := br.ReadByte(); err != io.EOF {
+				t.Errorf("%s: connection not closed: %v", tt.name, err)
+			}
+			continue
+		}
+		rep, _, err := socksRequestTo(c, br, socksConnect, echo.Addr().String())
+		if err != nil || rep != socksSucceeded {
+			t.Errorf("%s: connect %d %v", tt.name, rep, err)
+			continue
+		}
+		c.Write([]byte("ping"))
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(br, got); err != nil || string(got) != "ping" {
+			t.Errorf("%s: echo %q %v", tt.name, got, err)
+		}
+	}
+}
+
+// 80/443 嗅探之后交给 ProxyHandler, 目标是 IP 时用 SNI 作为上游的 host
+func TestSOCKS5Sniff(t *testing.T) {
+	var mu sync.Mutex
+	var hosts []string
+	ph := NewProxyHandler()
+	ph.Certs = NewCertStore(testCA(t))
+	ph.TLSConfig = newServerTLSConfig()
+	ph.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		hosts = append(hosts, req.URL.Scheme+"://"+req.URL.Host)
+		mu.Unlock()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte("ok"))),
+			Request:    req,
+		}, nil
+	})
+	addr := startSOCKS5(t, &SOCKS5{Proxy: ph})
+
+	tests := []struct {
+		name string
+		dst  string
+		// 空是 http, 否则是 tls 的 SNI, "-" 不发送 SNI
+		sni  string
+		want string
+	}{
+		{"http domain", "example.com:80", "", "http://example.com:80"},
+		{"http ip", "192.0.2.1:80", "", "http://192.0.2.1:80"},
+		{"tls domain", "example.com:443", "example.com", "https://example.com:443"},
+		{"tls ipv4 sni", "192.0.2.1:443", "example.com", "https://example.com:443"},
+		{"tls ipv6 sni", "[2001:db8::1]:443", "example.com", "https://example.com:443"},
+		{"tls ip no sni", "192.0.2.1:443", "-", "https://192.0.2.1:443"},
+	}
+	for _, tt := range tests {
+		c, br := dialSOCKS5(t, addr)
+		if err := socksHandshake(c, br, "", ""); err != nil {
+			t.Fatal(err)
+		}
+		if rep, _, err := socksRequestTo(c, br, socksConnect, tt.dst); err != nil || rep != socksSucceeded {
+			t.Fatalf("%s: connect %d %v", tt.name, rep, err)
+		}
+		var conn net.Conn = c
+		if tt.sni != "" {
+			config := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}}
+			if tt.sni != "-" {
+				config.ServerName = tt.sni
+			}
+			conn = tls.Client(c, config)
+			br = bufio.NewReader(conn)
+		}
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK || string(body) != "ok" {
+			t.Errorf("%s: got %d %q", tt.name, res.StatusCode, body)
+		}
+		mu.Lock()
+		got := hosts[len(hosts)-1]
+		mu.Unlock()
+		if got != tt.want {
+			t.Errorf("%s: upstream %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(append([]byte("echo "), buf[:n]...), from)
+		}
+	}()
+
+	c, br := dialSOCKS5(t, startSOCKS5(t, &SOCKS5{}))
+	if err := socksHandshake(c, br, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	rep, relay, err := socksRequestTo(c, br, socksUDPAssociate, "0.0.0.0:0")
+	if err != nil || rep != socksSucceeded {
+		t.Fatalf("associate %d %v", rep, err)
+	}
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	raddr, err := net.ResolveUDPAddr("udp", relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := echo.LocalAddr().(*net.UDPAddr)
+	pkt := appendSocksAddr([]byte{0, 0, 0}, dst)
+	// 分片的包丢弃
+	client.WriteTo(append([]byte{0, 0, 1}, pkt[3:]...), raddr)
+	client.WriteTo(append(pkt, "hello"...), raddr)
+
+	buf := make([]byte, 1024)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(buf[3:n])
+	host, port, err := readSocksAddr(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from := net.JoinHostPort(host, strconv.Itoa(port)); !bytes.Equal(buf[:3], []byte{0, 0, 0}) || from != dst.String() {
+		t.Fatalf("reply header %v from %s, want %s", buf[:3], from, dst)
+	}
+	if data, _ := ioutil.ReadAll(r); string(data) != "echo hello" {
+		t.Fatalf("got %q", data)
+	}
+}
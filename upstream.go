@@ -0,0 +1,230 @@
+package gproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	// 探测连接留给 Transport 复用的时间
+	warmConnTimeout = 10 * time.Second
+	// 上游 ALPN 结果缓存时间
+	alpnCacheTimeout = 10 * time.Minute
+)
+
+// upstream dials tls connections for http.Transport,
+// 和客户端握手时提前建立的上游连接会留给 Transport 复用
+type upstream struct {
+	transport *http.Transport
+	mu        sync.Mutex
+	warm      map[string][]*warmConn
+	protos    map[string]alpnEntry
+
+	h1once sync.Once
+	h1     *http.Transport
+}
+
+type warmConn struct {
+	conn *tls.Conn
+}
+
+type alpnEntry struct {
+	proto   string
+	expires time.Time
+}
+
+func newUpstream(t *http.Transport) *upstream {
+	up := &upstream{
+		transport: t,
+		warm:      make(map[string][]*warmConn),
+		protos:    make(map[string]alpnEntry),
+	}
+	t.DialTLSContext = up.dialTLS
+	if err := http2.ConfigureTransport(t); err != nil {
+		logger.Println("configure h2 transport:", err)
+	}
+	return up
+}
+
+// dialTLS 优先使用握手时建立的连接
+func (up *upstream) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c := up.takeWarm(addr); c != nil {
+		return c, nil
+	}
+	return up.dial(ctx, addr, []string{http2.NextProtoTLS, "http/1.1"})
+}
+
+// h1Transport 只使用 http/1.1, 用于 websocket 等 Upgrade 请求.
+// 自定义 DialTLSContext 时 Transport 不管请求是不是 Upgrade,
+// 协商出 h2 的连接都会交给 http2 的 RoundTripper, 它不支持 Upgrade
+func (up *upstream) h1Transport() *http.Transport {
+	up.h1once.Do(func() {
+		t := up.transport.Clone()
+		t.DialTLSContext = up.dialH1
+		t.ForceAttemptHTTP2 = false
+		// 非 nil 的空 map 关闭 h2, 走上级代理时 tls 由 Transport 自己握手
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		if t.TLSClientConfig != nil {
+			t.TLSClientConfig.NextProtos = nil
+		}
+		up.h1 = t
+	})
+	return up.h1
+}
+
+// dialH1 不使用探测 ALPN 时留下的连接, 它们可能是 h2
+func (up *upstream) dialH1(ctx context.Context, network, addr string) (net.Conn, error) {
+	return up.dial(ctx, addr, []string{"http/1.1"})
+}
+
+func (up *upstream) dial(ctx context.Context, addr string, protos []string) (*tls.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var config *tls.Config
+	if up.transport.TLSClientConfig != nil {
+		config = up.transport.TLSClientConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	config.NextProtos = protos
+	conn := tls.Client(raw, config)
+	if d := up.transport.TLSHandshakeTimeout; d != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// alpn 按照上游支持的协议决定给客户端的 NextProtos
+func (up *upstream) alpn(addr string, offered []string) []string {
+	var offer []string
+	for _, p := range offered {
+		if p == http2.NextProtoTLS || p == "http/1.1" {
+			offer = append(offer, p)
+		}
+	}
+	if len(offer) == 0 || up.proxied(addr) {
+		return offer
+	}
+	proto, ok := up.cachedProto(addr)
+	if !ok {
+		ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+		// 和 Transport 一样提供两种协议, 探测的连接才能留给 Transport
+		conn, err := up.dial(ctx, addr, []string{http2.NextProtoTLS, "http/1.1"})
+		cancel()
+		if err != nil {
+			// 上游连不上, 后面的请求会返回 502
+			logger.Printf("alpn probe %s %s \n", addr, err)
+			return offer
+		}
+		proto = conn.ConnectionState().NegotiatedProtocol
+		up.setProto(addr, proto)
+		up.putWarm(addr, conn)
+	}
+	if proto == "" {
+		proto = "http/1.1"
+	}
+	for _, p := range offer {
+		if p == proto {
+			return []string{proto}
+		}
+	}
+	return offer
+}
+
+// 走了上级代理的连接没办法直接探测
+func (up *upstream) proxied(addr string) bool {
+	if up.transport.Proxy == nil {
+		return false
+	}
+	req, err := http.NewRequest("GET", "https://"+addr, nil)
+	if err != nil {
+		return false
+	}
+	u, err := up.transport.Proxy(req)
+	return err != nil || u != nil
+}
+
+func (up *upstream) cachedProto(addr string) (string, bool) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	e, ok := up.protos[addr]
+	if !ok || time.Now().After(e.expires) {
+		delete(up.protos, addr)
+		return "", false
+	}
+	return e.proto, true
+}
+
+func (up *upstream) setProto(addr, proto string) {
+	up.mu.Lock()
+	up.protos[addr] = alpnEntry{proto: proto, expires: time.Now().Add(alpnCacheTimeout)}
+	up.mu.Unlock()
+}
+
+func (up *upstream) putWarm(addr string, conn *tls.Conn) {
+	wc := &warmConn{conn: conn}
+	up.mu.Lock()
+	up.warm[addr] = append(up.warm[addr], wc)
+	up.mu.Unlock()
+	// Transport 一直没来取就关掉
+	time.AfterFunc(warmConnTimeout, func() {
+		if up.removeWarm(addr, wc) {
+			conn.Close()
+		}
+	})
+}
+
+func (up *upstream) takeWarm(addr string) *tls.Conn {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	conns := up.warm[addr]
+	if len(conns) == 0 {
+		return nil
+	}
+	wc := conns[len(conns)-1]
+	up.removeWarmLocked(addr, wc)
+	return wc.conn
+}
+
+func (up *upstream) removeWarm(addr string, wc *warmConn) bool {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.removeWarmLocked(addr, wc)
+}
+
+func (up *upstream) removeWarmLocked(addr string, wc *warmConn) bool {
+	conns := up.warm[addr]
+	for i, c := range conns {
+		if c == wc {
+			conns = append(conns[:i], conns[i+1:]...)
+			if len(conns) == 0 {
+				delete(up.warm, addr)
+			} else {
+				up.warm[addr] = conns
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,437 @@
+package gproxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wsContinuation = 0
+	wsText         = 1
+	wsBinary       = 2
+	wsClose        = 8
+
+	// 超过这个大小的 frame 不缓存, 直接转发, 也不应用规则
+	wsMaxFrame = 4 << 20
+	// 每个连接最多记录的 frame 数
+	wsMaxFrames = 10000
+)
+
+// WebSocketRule drops, modifies or injects frames of matched websocket connections,
+// 只作用于没有分片的 text 和 binary frame
+type WebSocketRule struct {
+	Name  string `json:"name,omitempty"`
+	Match Match  `json:"match"`
+	// send 客户端发给服务器, receive 服务器发给客户端, 空匹配两个方向
+	Direction string `json:"direction,omitempty"`
+	// 正则, 匹配 payload, 空匹配所有
+	Payload string `json:"payload,omitempty"`
+	// drop, modify, inject
+	Action string `json:"action"`
+	// modify 对 payload 做正则替换
+	Replace []*Replace `json:"replace,omitempty"`
+	// inject 在匹配的 frame 之后插入一个同方向的 text frame
+	Inject string `json:"inject,omitempty"`
+
+	payload *regexp.Regexp
+}
+
+func (w *WebSocketRule) compile() (err error) {
+	switch w.Direction {
+	case "", "send", "receive":
+	default:
+		return fmt.Errorf("websocket %s: unknown direction %q", w.Name, w.Direction)
+	}
+	switch w.Action {
+	case "drop", "inject":
+	case "modify":
+		for _, r := range w.Replace {
+			if r.re, err = regexp.Compile(r.Pattern); err != nil {
+				return
+			}
+		}
+	default:
+		return fmt.Errorf("websocket %s: unknown action %q", w.Name, w.Action)
+	}
+	if w.Payload != "" {
+		if w.payload, err = regexp.Compile(w.Payload); err != nil {
+			return
+		}
+	}
+	return w.Match.compile()
+}
+
+func (r *Rules) matchWebSocket(req *http.Request) []*WebSocketRule {
+	var rules []*WebSocketRule
+	for _, rule := range r.WebSocket {
+		if rule.Match.match(req) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// WebSocketFrame is a captured websocket frame
+type WebSocketFrame struct {
+	Time time.Time `json:"time"`
+	// send 客户端发给服务器, receive 服务器发给客户端
+	Direction string `json:"direction"`
+	Opcode    int    `json:"opcode"`
+	Fin       bool   `json:"fin"`
+	Length    int64  `json:"length"`
+	// 已经去掉 mask, 只保存前 MaxBodySize 字节
+	Payload   []byte `json:"payload,omitempty"`
+	CloseCode int    `json:"closeCode,omitempty"`
+	// 规则的动作: drop, modify, inject
+	Action string `json:"action,omitempty"`
+}
+
+// WebSocket is the captured frames of an upgraded connection
+type WebSocket struct {
+	mu     sync.Mutex
+	frames []*WebSocketFrame
+	// 超过 wsMaxFrames 没有记录的 frame 数
+	skipped int
+}
+
+// Frames returns the captured frames
+func (ws *WebSocket) Frames() []*WebSocketFrame {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return append([]*WebSocketFrame(nil), ws.frames...)
+}
+
+func (ws *WebSocket) add(f *WebSocketFrame) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if len(ws.frames) >= wsMaxFrames {
+		ws.skipped++
+		return
+	}
+	ws.frames = append(ws.frames, f)
+}
+
+// MarshalJSON 连接还没有关闭时也可以读取
+func (ws *WebSocket) MarshalJSON() ([]byte, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return json.Marshal(struct {
+		Frames  []*WebSocketFrame `json:"frames"`
+		Skipped int               `json:"skipped,omitempty"`
+	}{ws.frames, ws.skipped})
+}
+
+// isWebSocket 判断是否是 websocket 升级请求
+func isWebSocket(h http.Header) bool {
+	for _, v := range h["Upgrade"] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), "websocket") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// websocket 把升级之后的连接包装起来, 记录和修改 frame
+func (ph *ProxyHandler) websocket(res *http.Response, rules []*WebSocketRule) *http.Response {
+	f := flowFromContext(res.Request.Context())
+	if f == nil && len(rules) == 0 {
+		return res
+	}
+	rwc, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		return res
+	}
+	var ws *WebSocket
+	var max int64
+	if f != nil {
+		ws = new(WebSocket)
+		f.WebSocket = ws
+		max = ph.Flows.maxBodySize()
+	}
+	logger.Printf("websocket %s", res.Request.URL)
+	res.Body = &wsConn{
+		ReadWriteCloser: rwc,
+		recv:            wsStream{dir: "receive", rules: rules, ws: ws, max: max},
+		send:            wsStream{dir: "send", mask: true, rules: rules, ws: ws, max: max},
+	}
+	return res
+}
+
+// wsConn 是 ReverseProxy 拿到的上游连接, Read 是服务器发给客户端, Write 是客户端发给服务器
+type wsConn struct {
+	io.ReadWriteCloser
+	recv wsStream
+	send wsStream
+	buf  [32 * 1024]byte
+	out  []byte
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		n, err := c.ReadWriteCloser.Read(c.buf[:])
+		c.out = c.recv.feed(c.buf[:n])
+		if err != nil && len(c.out) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	out := c.send.feed(p)
+	if len(out) > 0 {
+		if _, err := c.ReadWriteCloser.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// wsStream 解析一个方向的 frame
+type wsStream struct {
+	dir   string
+	mask  bool
+	rules []*WebSocketRule
+	ws    *WebSocket
+	max   int64
+
+	buf []byte
+	// 直接转发的大 frame 还剩下的 payload
+	remain  int64
+	large   *WebSocketFrame
+	key     []byte
+	offset  int64
+	payload limitedBuffer
+}
+
+type wsHeader struct {
+	fin    bool
+	rsv    byte
+	opcode int
+	length int64
+	key    []byte
+}
+
+// parseWSHeader 返回 frame 头和它的长度, 数据不够时返回 0
+func parseWSHeader(b []byte) (h wsHeader, n int) {
+	if len(b) < 2 {
+		return h, 0
+	}
+	h.fin = b[0]&0x80 != 0
+	h.rsv = b[0] & 0x70
+	h.opcode = int(b[0] & 0x0f)
+	masked := b[1]&0x80 != 0
+	n = 2
+	switch l := b[1] & 0x7f; l {
+	case 126:
+		if len(b) < n+2 {
+			return h, 0
+		}
+		h.length = int64(binary.BigEndian.Uint16(b[n:]))
+		n += 2
+	case 127:
+		if len(b) < n+8 {
+			return h, 0
+		}
+		h.length = int64(binary.BigEndian.Uint64(b[n:]) & (1<<63 - 1))
+		n += 8
+	default:
+		h.length = int64(l)
+	}
+	if masked {
+		if len(b) < n+4 {
+			return h, 0
+		}
+		h.key = b[n : n+4]
+		n += 4
+	}
+	return h, n
+}
+
+func maskBytes(key, b []byte, offset int64) {
+	for i := range b {
+		b[i] ^= key[(offset+int64(i))%4]
+	}
+}
+
+// feed 处理收到的数据, 返回需要转发的数据
+func (s *wsStream) feed(p []byte) []byte {
+	s.buf = append(s.buf, p...)
+	buf := s.buf
+	var out []byte
+	for len(buf) > 0 {
+		if s.remain > 0 {
+			n := int64(len(buf))
+			if n > s.remain {
+				n = s.remain
+			}
+			s.record(buf[:n])
+			out = append(out, buf[:n]...)
+			buf = buf[n:]
+			if s.remain -= n; s.remain == 0 {
+				s.large.Payload = s.payload.Bytes()
+				s.add(s.large)
+			}
+			continue
+		}
+		h, n := parseWSHeader(buf)
+		if n == 0 {
+			break
+		}
+		if h.length > wsMaxFrame {
+			out = append(out, buf[:n]...)
+			s.large = s.newFrame(h, nil)
+			s.key = append(s.key[:0], h.key...)
+			s.offset = 0
+			s.payload = limitedBuffer{max: s.max}
+			s.remain = h.length
+			buf = buf[n:]
+			continue
+		}
+		end := n + int(h.length)
+		if len(buf) < end {
+			break
+		}
+		out = s.frame(out, h, buf[:end], buf[n:end])
+		buf = buf[end:]
+	}
+	s.buf = append(s.buf[:0], buf...)
+	return out
+}
+
+// record 记录直接转发的 frame 的 payload
+func (s *wsStream) record(b []byte) {
+	if s.ws != nil && int64(len(s.payload.Bytes())) < s.max {
+		b = append([]byte(nil), b...)
+		if len(s.key) == 4 {
+			maskBytes(s.key, b, s.offset)
+		}
+		s.payload.Write(b)
+	}
+	s.offset += int64(len(b))
+}
+
+func (s *wsStream) newFrame(h wsHeader, payload []byte) *WebSocketFrame {
+	f := &WebSocketFrame{
+		Time:      time.Now(),
+		Direction: s.dir,
+		Opcode:    h.opcode,
+		Fin:       h.fin,
+		Length:    h.length,
+	}
+	if h.opcode == wsClose && len(payload) >= 2 {
+		f.CloseCode = int(binary.BigEndian.Uint16(payload))
+	}
+	return f
+}
+
+func (s *wsStream) add(f *WebSocketFrame) {
+	if s.ws == nil {
+		return
+	}
+	if int64(len(f.Payload)) > s.max {
+		f.Payload = f.Payload[:s.max]
+	}
+	s.ws.add(f)
+}
+
+// frame 处理一个完整的 frame, raw 是原始数据
+func (s *wsStream) frame(out []byte, h wsHeader, raw, payload []byte) []byte {
+	payload = append([]byte(nil), payload...)
+	if len(h.key) == 4 {
+		maskBytes(h.key, payload, 0)
+	}
+	f := s.newFrame(h, payload)
+	f.Payload = payload
+	// 压缩过(rsv1)或者分片的 frame 不应用规则
+	if h.rsv != 0 || !h.fin || h.opcode != wsText && h.opcode != wsBinary {
+		s.add(f)
+		return append(out, raw...)
+	}
+	var injects []string
+	modified := false
+	for _, rule := range s.rules {
+		if rule.Direction != "" && rule.Direction != s.dir {
+			continue
+		}
+		if rule.payload != nil && !rule.payload.Match(payload) {
+			continue
+		}
+		switch rule.Action {
+		case "drop":
+			logger.Printf("websocket %s drop %s frame", rule.Name, s.dir)
+			f.Action = "drop"
+			s.add(f)
+			return out
+		case "modify":
+			payload = replaceAll(rule.Replace, payload)
+			modified = true
+		case "inject":
+			injects = append(injects, rule.Inject)
+		}
+	}
+	if modified {
+		f.Action = "modify"
+		f.Payload = payload
+		f.Length = int64(len(payload))
+		s.add(f)
+		out = s.appendFrame(out, h.opcode, payload)
+	} else {
+		s.add(f)
+		out = append(out, raw...)
+	}
+	for _, text := range injects {
+		s.add(&WebSocketFrame{
+			Time:      time.Now(),
+			Direction: s.dir,
+			Opcode:    wsText,
+			Fin:       true,
+			Length:    int64(len(text)),
+			Payload:   []byte(text),
+			Action:    "inject",
+		})
+		out = s.appendFrame(out, wsText, []byte(text))
+	}
+	return out
+}
+
+// appendFrame 编码一个完整的 frame, 客户端发出的 frame 需要 mask
+func (s *wsStream) appendFrame(out []byte, opcode int, payload []byte) []byte {
+	out = append(out, 0x80|byte(opcode))
+	var mask byte
+	if s.mask {
+		mask = 0x80
+	}
+	switch l := len(payload); {
+	case l < 126:
+		out = append(out, mask|byte(l))
+	case l <= 0xffff:
+		out = append(out, mask|126, byte(l>>8), byte(l))
+	default:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(l))
+		out = append(append(out, mask|127), b[:]...)
+	}
+	if !s.mask {
+		return append(out, payload...)
+	}
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, rand.Uint32())
+	out = append(out, key...)
+	start := len(out)
+	out = append(out, payload...)
+	maskBytes(key, out[start:], 0)
+	return out
+}
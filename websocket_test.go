@@ -0,0 +1,284 @@
+package gproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func testCA(t *testing.T) *CA {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := CreateRootCert(pkix.Name{Organization: []string{"gproxy test CA"}}, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CA{
+		cert: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv},
+		x509: cert,
+	}
+}
+
+// 上游支持 h2 时, 拦截的 websocket 也要用 http/1.1 连接上游
+func TestWebSocketMITMH2Upstream(t *testing.T) {
+	up := httptest.NewUnstartedServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+	up.EnableHTTP2 = true
+	up.StartTLS()
+	defer up.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(up.Certificate())
+	ph := NewProxyHandler()
+	ph.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: roots}
+	ph.Certs = NewCertStore(testCA(t))
+	ph.TLSConfig = newServerTLSConfig()
+	ps := httptest.NewServer(ph)
+	defer ps.Close()
+
+	addr := up.Listener.Addr().String()
+	// 第一次使用探测 ALPN 时留下的连接, 第二次 Transport 自己建立连接
+	for i := 0; i < 2; i++ {
+		ws, err := dialWebSocket(t, ps.Listener.Addr().String(), addr)
+		if err != nil {
+			t.Fatalf("#%d websocket handshake: %v", i, err)
+		}
+		msg := fmt.Sprintf("ping %d", i)
+		if err := websocket.Message.Send(ws, msg); err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if err := websocket.Message.Receive(ws, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != msg {
+			t.Fatalf("#%d got %q, want %q", i, got, msg)
+		}
+		ws.Close()
+	}
+}
+
+// dialWebSocket 通过 proxy 的 CONNECT 拦截连接 addr 上的 websocket
+func dialWebSocket(t *testing.T, proxy, addr string) (*websocket.Conn, error) {
+	c, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	res, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status %d", res.StatusCode)
+	}
+	tc := tls.Client(c, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	config, err := websocket.NewConfig("wss://"+addr+"/", "https://"+addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return websocket.NewClient(config, tc)
+}
+
+// websocketFlow 返回 store 里唯一的 websocket flow
+func websocketFlow(t *testing.T, store *FlowStore) *Flow {
+	t.Helper()
+	var found *Flow
+	for _, f := range store.Query(FlowQuery{}) {
+		if f.WebSocket != nil {
+			if found != nil {
+				t.Fatalf("more than one websocket flow")
+			}
+			found = f
+		}
+	}
+	if found == nil {
+		t.Fatalf("websocket flow not in store")
+	}
+	return found
+}
+
+func TestWebSocketFlowAndRules(t *testing.T) {
+	// 原样返回, 收到 bye 时关闭连接
+	up := httptest.NewTLSServer(websocket.Handler(func(ws *websocket.Conn) {
+		var msg string
+		for websocket.Message.Receive(ws, &msg) == nil && msg != "bye" {
+			websocket.Message.Send(ws, msg)
+		}
+		ws.Close()
+	}))
+	defer up.Close()
+
+	rules := &Rules{WebSocket: []*WebSocketRule{
+		{Name: "drop", Direction: "send", Payload: "^secret", Action: "drop"},
+		{Name: "modify", Direction: "receive", Payload: "^hello$", Action: "modify",
+			Replace: []*Replace{{Pattern: "l+", With: "L"}}},
+		{Name: "inject", Direction: "send", Payload: "^inject", Action: "inject", Inject: "extra"},
+	}}
+	if err := rules.compile(); err != nil {
+		t.Fatal(err)
+	}
+	ph := NewProxyHandler()
+	ph.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	ph.Certs = NewCertStore(testCA(t))
+	ph.TLSConfig = newServerTLSConfig()
+	ph.Flows = NewFlowStore(16)
+	ph.Rules = rules
+	ps := httptest.NewServer(ph)
+	defer ps.Close()
+
+	ws, err := dialWebSocket(t, ps.Listener.Addr().String(), up.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	// secret 1 被丢弃, 服务器收到的 hello 和 inject 的 extra 原样返回
+	for _, step := range []struct {
+		send []string
+		recv []string
+	}{
+		{[]string{"secret 1", "hello"}, []string{"heLo"}},
+		{[]string{"inject me"}, []string{"inject me", "extra"}},
+	} {
+		for _, msg := range step.send {
+			if err := websocket.Message.Send(ws, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, want := range step.recv {
+			var got string
+			if err := websocket.Message.Receive(ws, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Fatalf("client got %q, want %q", got, want)
+			}
+		}
+	}
+
+	// 连接还没有关闭, flow 已经可以查到
+	f := websocketFlow(t, ph.Flows)
+	if f.Response == nil || f.Response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("flow response %+v", f.Response)
+	}
+	type frame struct {
+		dir, payload, action string
+	}
+	want := []frame{
+		{"send", "secret 1", "drop"},
+		{"send", "hello", ""},
+		{"receive", "heLo", "modify"},
+		{"send", "inject me", ""},
+		{"send", "extra", "inject"},
+		{"receive", "inject me", ""},
+		{"receive", "extra", ""},
+	}
+	frames := f.WebSocket.Frames()
+	if len(frames) != len(want) {
+		t.Fatalf("recorded %d frames, want %d", len(frames), len(want))
+	}
+	for i, w := range want {
+		fr := frames[i]
+		got := frame{fr.Direction, string(fr.Payload), fr.Action}
+		if got != w || fr.Opcode != wsText || !fr.Fin || fr.Length != int64(len(w.payload)) {
+			t.Errorf("#%d got %+v opcode %d fin %v length %d, want %+v", i, got, fr.Opcode, fr.Fin, fr.Length, w)
+		}
+	}
+
+	// 服务器关闭连接, 之后的 frame 继续记录到同一个 flow
+	if err := websocket.Message.Send(ws, "bye"); err != nil {
+		t.Fatal(err)
+	}
+	var msg string
+	if err := websocket.Message.Receive(ws, &msg); err != io.EOF {
+		t.Fatalf("receive after close: %q %v", msg, err)
+	}
+	// 客户端回复的 close frame 可能来不及转发, 只检查服务器发出的
+	frames = f.WebSocket.Frames()
+	if len(frames) < len(want)+2 {
+		t.Fatalf("recorded %d frames after close, want at least %d", len(frames), len(want)+2)
+	}
+	if bye := frames[len(want)]; bye.Direction != "send" || string(bye.Payload) != "bye" {
+		t.Errorf("got %s %q, want send bye", bye.Direction, bye.Payload)
+	}
+	if c := frames[len(want)+1]; c.Direction != "receive" || c.Opcode != wsClose || c.CloseCode != 1000 {
+		t.Errorf("got %s opcode %d close code %d, want receive close 1000", c.Direction, c.Opcode, c.CloseCode)
+	}
+	if got := websocketFlow(t, ph.Flows); got != f {
+		t.Fatalf("flow added twice")
+	}
+}
+
+// 普通 http 升级的连接被 ReverseProxy Hijack 之后, Shutdown 也要等待, ctx 结束时关闭
+func TestWebSocketShutdown(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		c, brw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		io.Copy(c, brw)
+	}))
+	defer up.Close()
+	ph := NewProxyHandler()
+	ps := httptest.NewServer(ph)
+	defer ps.Close()
+
+	c, err := net.Dial("tcp", ps.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	host := up.Listener.Addr().String()
+	fmt.Fprintf(c, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n", host, host)
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d", res.StatusCode)
+	}
+	ping := func() error {
+		c.Write([]byte("ping"))
+		b := make([]byte, 4)
+		_, err := io.ReadFull(br, b)
+		return err
+	}
+	if err := ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := ph.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := ping(); err == nil {
+		t.Fatalf("upgraded connection still open after Shutdown")
+	}
+}